@@ -1,127 +1,113 @@
 package raknet
 
 import (
-	"bytes"
+	"errors"
 	"github.com/cr0sh/encore/util/binary"
 	"github.com/sirupsen/logrus"
 	"io"
-	"sort"
+	"slices"
 )
 
 // ACKMap is a set type for saving ACK/NACK packet IDs.
 type ACKMap = map[uint32]struct{}
 
+// maxACKKeys limits the number of keys decoded from an ACK/NACK packet,
+// so that a few bytes of ranges do not expand to millions of keys.
+const maxACKKeys = 4 * WindowSize
+
+// ErrACKTooLarge is returned when an ACK/NACK packet has more than maxACKKeys keys.
+var ErrACKTooLarge = errors.New("raknet: too many keys in ACK")
+
 // EncodeACK encodes given ACKMap to Writer.
 func EncodeACK(ack ACKMap, wr io.Writer) error {
-	var warned bool
-
-	b := make([]byte, 7)
-	keys := make([]int, len(ack))
-	i := 0
-	for k, _ := range ack {
-		keys[i] = int(k)
-		i++
+	keys := make([]uint32, 0, len(ack))
+	for k := range ack {
+		keys = append(keys, k)
 	}
-	sort.Ints(keys)
-
-	buf := new(bytes.Buffer)
-	keycnt := len(keys)
-	records := 0
+	_, err := wr.Write(appendACK(nil, keys))
+	return err
+}
 
-	if keycnt > 0 {
-		ptr := 1
-		start := keys[0]
-		end := keys[0]
+// appendACK appends keys encoded as ACK/NACK records to b.
+// keys are sorted in place, and consecutive ones are encoded as a range.
+func appendACK(b []byte, keys []uint32) []byte {
+	var warned bool
+	slices.Sort(keys)
 
-		for ptr < keycnt {
-			current := keys[ptr]
-			ptr++
-			diff := current - end
-			if diff == 1 {
-				end = current
-			} else if diff > 1 {
-				if start == end {
-					b[0] = 0x01
-					binary.LittleEndian.PutTriad(b[1:4], uint32(start))
-					end = current
-					start = end
-					if _, err := buf.Write(b[:4]); err != nil {
-						return err
-					}
-				} else {
-					b[0] = 0x00
-					binary.LittleEndian.PutTriad(b[1:4], uint32(start))
-					binary.LittleEndian.PutTriad(b[4:7], uint32(end))
-					end = current
-					start = end
-					if _, err := buf.Write(b); err != nil {
-						return err
-					}
-				}
-				records++
-			} else {
-				if !warned {
-					logrus.Warn("Duplicate ACK Key while encoding(maybe by a bad ACK/NACK Queue?)")
-					warned = true
-				}
+	countPos := len(b)
+	b = append(b, 0, 0)
+	records := 0
+	for i := 0; i < len(keys); records++ {
+		start, end := keys[i], keys[i]
+		for i++; i < len(keys) && keys[i] <= end+1; i++ {
+			if keys[i] == end && !warned {
+				logrus.Warn("Duplicate ACK Key while encoding(maybe by a bad ACK/NACK Queue?)")
+				warned = true
 			}
+			end = keys[i]
 		}
 
+		var buf []byte
 		if start == end {
-			b[0] = 0x01
-			binary.LittleEndian.PutTriad(b[1:4], uint32(start))
-			buf.Write(b[:4])
+			b, buf = grow(b, 4)
+			buf[0] = 0x01
+			binary.LittleEndian.PutTriad(buf[1:4], start)
 		} else {
-			b[0] = 0x00
-			binary.LittleEndian.PutTriad(b[1:4], uint32(start))
-			binary.LittleEndian.PutTriad(b[4:7], uint32(end))
-			buf.Write(b)
+			b, buf = grow(b, 7)
+			buf[0] = 0x00
+			binary.LittleEndian.PutTriad(buf[1:4], start)
+			binary.LittleEndian.PutTriad(buf[4:7], end)
 		}
 	}
-
-	binary.BigEndian.PutUint16(b[:2], uint16(records))
-	if _, err := wr.Write(b[:2]); err != nil {
-		return err
-	}
-
-	_, err := io.Copy(wr, buf)
-	return err
+	binary.BigEndian.PutUint16(b[countPos:], uint16(records))
+	return b
 }
 
 // DecodeACK returns decoded list from reader.
+// Ranges with end before start, or over maxACKKeys keys in total are rejected.
 func DecodeACK(rd io.Reader) ([]uint32, error) {
-	b := make([]byte, 7)
-
-	if _, err := rd.Read(b[:2]); err != nil {
+	b, err := io.ReadAll(rd)
+	if err != nil {
 		return nil, err
 	}
+	return decodeACK(make([]uint32, 0), b)
+}
 
+// decodeACK appends keys decoded from b to keys.
+func decodeACK(keys []uint32, b []byte) ([]uint32, error) {
+	if len(b) < 2 {
+		return keys, io.ErrUnexpectedEOF
+	}
 	keyscnt := int(binary.BigEndian.Uint16(b))
-	keys := make([]uint32, 0, keyscnt)
+	b = b[2:]
+	base := len(keys)
 
 	for i := 0; i < keyscnt; i++ {
-		if _, err := rd.Read(b[:1]); err != nil {
-			return keys, err
+		if len(b) < 1 {
+			return keys, io.ErrUnexpectedEOF
 		}
 		if b[0] == 0 {
-			if _, err := rd.Read(b[:6]); err != nil {
-				return keys, err
+			if len(b) < 7 {
+				return keys, io.ErrUnexpectedEOF
+			}
+			start := binary.LittleEndian.Triad(b[1:4])
+			end := binary.LittleEndian.Triad(b[4:7])
+			b = b[7:]
+			if end < start || int(end-start) >= maxACKKeys-(len(keys)-base) {
+				return keys, ErrACKTooLarge
 			}
-			start := binary.LittleEndian.Triad(b[:3])
-			end := binary.LittleEndian.Triad(b[3:6])
-			/*
-				if end - start > 512 {
-					end = start + 512
-				}
-			*/
 			for j := start; j <= end; j++ {
 				keys = append(keys, uint32(j))
 			}
 		} else {
-			if _, err := rd.Read(b[:3]); err != nil {
-				return keys, err
+			if len(b) < 4 {
+				return keys, io.ErrUnexpectedEOF
+			}
+			if len(keys)-base >= maxACKKeys {
+				return keys, ErrACKTooLarge
 			}
-			keys = append(keys, uint32(binary.LittleEndian.Triad(b[:3])))
+			keys = append(keys, uint32(binary.LittleEndian.Triad(b[1:4])))
+			b = b[4:]
 		}
 	}
 
@@ -0,0 +1,48 @@
+package raknet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestACK(t *testing.T) {
+	cases := [][]uint32{
+		{},
+		{0},
+		{1, 2, 3},
+		{0, 2, 3, 4, 7},
+	}
+
+	for i, c := range cases {
+		ack := make(ACKMap)
+		for _, k := range c {
+			ack[k] = struct{}{}
+		}
+		buf := new(bytes.Buffer)
+		if err := EncodeACK(ack, buf); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := DecodeACK(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, c) {
+			t.Errorf("Test #%d: expected %v, got %v", i, c, keys)
+		}
+	}
+}
+
+func TestACKTooLarge(t *testing.T) {
+	cases := [][]byte{
+		{0, 1, 0, 0, 0, 0, 0xff, 0xff, 0xff},          // range 0..0xffffff
+		{0, 1, 0, 5, 0, 0, 1, 0, 0},                   // end before start
+		{0, 2, 0, 0, 0, 0, 0xff, 0x0f, 0, 1, 0, 0, 0}, // range of maxACKKeys, then one key
+	}
+
+	for i, c := range cases {
+		if _, err := DecodeACK(bytes.NewReader(c)); err != ErrACKTooLarge {
+			t.Errorf("Test #%d: expected %v, got %v", i, ErrACKTooLarge, err)
+		}
+	}
+}
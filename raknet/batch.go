@@ -0,0 +1,150 @@
+package raknet
+
+import (
+	"golang.org/x/net/ipv4"
+	"net"
+	"sync"
+)
+
+// maxBatch is the largest number of datagrams read or written in a single syscall.
+const maxBatch = 64
+
+// batchConn reads and writes multiple datagrams in a single syscall.
+// Both ipv4.PacketConn and ipv6.PacketConn implement it.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchReader reads datagrams from a PacketConn, up to maxBatch at once
+// if the platform supports batched I/O.
+type batchReader struct {
+	conn  net.PacketConn
+	batch batchConn
+	msgs  []ipv4.Message
+}
+
+func newBatchReader(conn net.PacketConn) *batchReader {
+	r := &batchReader{conn: conn, batch: newBatchConn(conn)}
+	n := 1
+	if r.batch != nil {
+		n = maxBatch
+	}
+	r.msgs = make([]ipv4.Message, n)
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{make([]byte, maxDatagramSize)}
+	}
+	return r
+}
+
+// read reads datagrams and returns them as messages, whose datagram is
+// Buffers[0][:N] sent from Addr. The buffers are reused by the next read.
+func (r *batchReader) read() ([]ipv4.Message, error) {
+	if r.batch != nil {
+		n, err := r.batch.ReadBatch(r.msgs, 0)
+		if err != nil {
+			return nil, err
+		}
+		return r.msgs[:n], nil
+	}
+	m := &r.msgs[0]
+	n, addr, err := r.conn.ReadFrom(m.Buffers[0])
+	if err != nil {
+		return nil, err
+	}
+	m.N, m.Addr = n, addr
+	return r.msgs[:1], nil
+}
+
+// batchWriter writes datagrams to a PacketConn. While the writer is held,
+// datagrams are queued and written in batches when it is released, so that
+// DataPackets and ACKs of several sessions go out in a single syscall.
+// Without batched I/O support, datagrams are written immediately.
+type batchWriter struct {
+	conn  net.PacketConn
+	batch batchConn
+
+	mu   sync.Mutex
+	held int
+	msgs []ipv4.Message
+	bufs []*[]byte // pooled copies of queued datagrams
+}
+
+func newBatchWriter(conn net.PacketConn) *batchWriter {
+	w := &batchWriter{conn: conn, batch: newBatchConn(conn)}
+	if w.batch != nil {
+		msgs := make([]ipv4.Message, maxBatch)
+		for i := range msgs {
+			msgs[i].Buffers = make([][]byte, 1)
+		}
+		w.msgs = msgs[:0]
+		w.bufs = make([]*[]byte, 0, maxBatch)
+	}
+	return w
+}
+
+// hold makes the writer queue datagrams until release.
+func (w *batchWriter) hold() {
+	w.mu.Lock()
+	w.held++
+	w.mu.Unlock()
+}
+
+// release writes queued datagrams if no one else holds the writer.
+func (w *batchWriter) release() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held--; w.held > 0 {
+		return nil
+	}
+	return w.flush()
+}
+
+// writeTo writes b to addr, or queues a copy of b while the writer is held.
+func (w *batchWriter) writeTo(b []byte, addr net.Addr) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held == 0 || w.batch == nil {
+		_, err := w.conn.WriteTo(b, addr)
+		return err
+	}
+
+	buf := getBuffer()
+	*buf = append(*buf, b...)
+	w.bufs = append(w.bufs, buf)
+	w.msgs = w.msgs[:len(w.msgs)+1]
+	m := &w.msgs[len(w.msgs)-1]
+	m.Buffers[0], m.Addr = *buf, addr
+	if len(w.msgs) >= maxBatch {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush writes queued datagrams. A datagram failed to be written is dropped
+// like a lost one, and the first error is returned after writing the rest.
+func (w *batchWriter) flush() error {
+	var err error
+	for msgs := w.msgs; len(msgs) > 0; {
+		n, e := w.batch.WriteBatch(msgs, 0)
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			if n < 0 {
+				n = 0
+			}
+			if n < len(msgs) {
+				n++
+			}
+		}
+		msgs = msgs[n:]
+	}
+	for i := range w.msgs {
+		w.msgs[i].Buffers[0], w.msgs[i].Addr = nil, nil
+		putBuffer(w.bufs[i])
+		w.bufs[i] = nil
+	}
+	w.msgs, w.bufs = w.msgs[:0], w.bufs[:0]
+	return err
+}
@@ -0,0 +1,20 @@
+package raknet
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// newBatchConn returns a batchConn of conn using recvmmsg and sendmmsg,
+// or nil if conn is not a UDP socket.
+func newBatchConn(conn net.PacketConn) batchConn {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	if addr, ok := udp.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(udp)
+	}
+	return ipv4.NewPacketConn(udp)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package raknet
+
+import (
+	"net"
+)
+
+// newBatchConn returns nil as batched I/O is not supported on this platform.
+func newBatchConn(conn net.PacketConn) batchConn {
+	return nil
+}
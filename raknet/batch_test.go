@@ -0,0 +1,64 @@
+package raknet
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBatchWriter(t *testing.T) {
+	cases := []string{"127.0.0.1:0", "[::1]:0", ":0"}
+	for i, c := range cases {
+		conn, err := net.ListenPacket("udp", c)
+		if err != nil {
+			t.Logf("Test #%d: skipped(%v)", i, err)
+			continue
+		}
+		peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if c == "[::1]:0" {
+			peer, err = net.ListenPacket("udp", c)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := newBatchWriter(conn)
+		if runtime.GOOS == "linux" && w.batch == nil {
+			t.Errorf("Test #%d: expected batched I/O on Linux", i)
+		}
+		const n = 3
+		w.hold()
+		for j := 0; j < n; j++ {
+			if err := w.writeTo([]byte{byte(j)}, peer.LocalAddr()); err != nil {
+				t.Fatalf("Test #%d: %v", i, err)
+			}
+		}
+		r := newBatchReader(peer)
+		if w.batch != nil {
+			peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if _, err := r.read(); err == nil {
+				t.Errorf("Test #%d: expected datagrams queued while held", i)
+			}
+		}
+		if err := w.release(); err != nil {
+			t.Fatalf("Test #%d: %v", i, err)
+		}
+
+		for j := 0; j < n; {
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			msgs, err := r.read()
+			if err != nil {
+				t.Fatalf("Test #%d: expected %d datagrams, got %d(error %v)", i, n, j, err)
+			}
+			for _, m := range msgs {
+				if m.N != 1 || m.Buffers[0][0] != byte(j) {
+					t.Errorf("Test #%d: expected datagram %d, got %v", i, j, m.Buffers[0][:m.N])
+				}
+				j++
+			}
+		}
+		conn.Close()
+		peer.Close()
+	}
+}
@@ -0,0 +1,45 @@
+package raknet
+
+import (
+	"sync"
+)
+
+// bufferPool holds buffers for encoding datagrams, to avoid an allocation
+// for each datagram sent. Pointers to slices are pooled so that putting
+// them back does not allocate either.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, maxDatagramSize)
+		return &b
+	},
+}
+
+// getBuffer returns an empty buffer from bufferPool.
+func getBuffer() *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// putBuffer puts b back to bufferPool. b must not be used after putBuffer.
+func putBuffer(b *[]byte) {
+	bufferPool.Put(b)
+}
+
+// ownChunkSize is the size of buffers Session.own copies payloads into.
+const ownChunkSize = 16 << 10
+
+// own returns a copy of b, which is never reused so it can be kept after
+// the buffer of b is reused. Small payloads are copied into a shared chunk,
+// to avoid an allocation for each of them.
+func (sess *Session) own(b []byte) []byte {
+	if len(b) > ownChunkSize/4 {
+		return append([]byte(nil), b...)
+	}
+	if len(b) > cap(sess.chunk)-len(sess.chunk) {
+		sess.chunk = make([]byte, 0, ownChunkSize)
+	}
+	n := len(sess.chunk)
+	sess.chunk = append(sess.chunk, b...)
+	return sess.chunk[n:len(sess.chunk):len(sess.chunk)]
+}
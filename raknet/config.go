@@ -0,0 +1,242 @@
+package raknet
+
+import (
+	"time"
+)
+
+const (
+	// DefaultMTU is a MTU size used when Config.MTU is not set.
+	DefaultMTU = 1492
+
+	// MinMTU is the smallest MTU size negotiated with remote.
+	MinMTU = 576
+
+	// MaxMTU is the largest MTU size, whose datagrams fit in read buffers.
+	MaxMTU = maxDatagramSize + ipUDPHeaderLen
+
+	// DefaultHandshakeTimeout is used when Config.HandshakeTimeout is not set.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DefaultUpdateInterval is used when Config.UpdateInterval is not set.
+	DefaultUpdateInterval = 10 * time.Millisecond
+
+	// DefaultMaxResends is used when Config.MaxResends is not set.
+	DefaultMaxResends = 10
+
+	// DefaultTimeout is used when Config.Timeout is not set.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultPingInterval is used when Config.PingInterval is not set.
+	DefaultPingInterval = 2 * time.Second
+
+	// DefaultMaxSplitPools is used when Config.MaxSplitPools is not set.
+	DefaultMaxSplitPools = 64
+
+	// DefaultMaxSplitCount is used when Config.MaxSplitCount is not set.
+	DefaultMaxSplitCount = 1024
+
+	// DefaultMaxSplitBytes is used when Config.MaxSplitBytes is not set.
+	DefaultMaxSplitBytes = 4 << 20
+
+	// DefaultMaxOrderBytes is used when Config.MaxOrderBytes is not set.
+	DefaultMaxOrderBytes = 4 << 20
+
+	// DefaultSplitTimeout is used when Config.SplitTimeout is not set.
+	DefaultSplitTimeout = 30 * time.Second
+)
+
+// Config is a set of options for Listener and Dial.
+// Zero-valued fields are replaced with defaults, and nil Config
+// pointer is treated as a zero-valued Config.
+type Config struct {
+	// ServerName is sent with UnconnectedPong.
+	ServerName string
+
+	// Status is called for every UnconnectedPing, and the returned status is
+	// sent with UnconnectedPong instead of ServerName. It may be called
+	// concurrently by shards of Listener, so it must be safe for concurrent use
+	// and must not block.
+	Status func() ServerStatus
+
+	// MTU is the maximum MTU size negotiated with remote, up to MaxMTU.
+	MTU int
+
+	// HandshakeTimeout limits the time Dial waits for the connection handshake.
+	HandshakeTimeout time.Duration
+
+	// UpdateInterval is a tick interval of Session.Update called by Listener and Dial.
+	UpdateInterval time.Duration
+
+	// MaxResends is the number of resends of a DataPacket without ACK
+	// after which the session is timed out.
+	MaxResends int
+
+	// Timeout is a silence interval after which the session is timed out.
+	Timeout time.Duration
+
+	// PingInterval is an interval of ConnectedPing sent to keep connected sessions alive.
+	PingInterval time.Duration
+
+	// MaxSplitPools limits split packets being reassembled at once per session.
+	MaxSplitPools int
+
+	// MaxSplitCount limits the number of fragments of a split packet.
+	MaxSplitCount int
+
+	// MaxSplitBytes limits total bytes of fragments being reassembled per session.
+	MaxSplitBytes int
+
+	// SplitTimeout is an interval after which incomplete split packets are discarded.
+	SplitTimeout time.Duration
+
+	// MaxOrderBytes limits total bytes of reliable ordered packets buffered
+	// until the packets before them arrive, per session. Datagrams over
+	// the limit are dropped without ACK, so the remote resends them later.
+	MaxOrderBytes int
+
+	// Limiter limits offline packets handled by Listener for each source IP.
+	// If nil, a TokenBucket with DefaultOfflineRate and DefaultOfflineBurst is used.
+	Limiter Limiter
+
+	// BanDuration is a duration of the temporary ban of addresses which
+	// sent malformed offline packets. Bans apply to all shards of Listener.
+	BanDuration time.Duration
+
+	// MaxBans limits the number of banned addresses. If more addresses are
+	// banned, the oldest bans are lifted.
+	MaxBans int
+
+	// DisableSecurity disables the security cookie of OpenConnectionReply1,
+	// which prevents sessions from being created for spoofed addresses.
+	DisableSecurity bool
+
+	// MaxConnections limits sessions of Listener. Zero means no limit.
+	MaxConnections int
+
+	// Shards is a number of sockets opened by Listen on the same port with
+	// SO_REUSEPORT, each served by its own goroutine. The kernel hashes
+	// source addresses to pick a socket, so each session stays on a shard.
+	// Sharding is supported only on Linux. Zero means 1.
+	Shards int
+}
+
+func (c *Config) mtu() int {
+	if c == nil || c.MTU <= 0 {
+		return DefaultMTU
+	}
+	if c.MTU < MinMTU {
+		return MinMTU
+	} else if c.MTU > MaxMTU {
+		return MaxMTU
+	}
+	return c.MTU
+}
+
+// clampMTU bounds the MTU size requested by remote into [MinMTU, c.mtu()].
+func (c *Config) clampMTU(mtu int) int {
+	if mtu > c.mtu() {
+		return c.mtu()
+	}
+	if mtu < MinMTU {
+		return MinMTU
+	}
+	return mtu
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c == nil || c.HandshakeTimeout <= 0 {
+		return DefaultHandshakeTimeout
+	}
+	return c.HandshakeTimeout
+}
+
+func (c *Config) updateInterval() time.Duration {
+	if c == nil || c.UpdateInterval <= 0 {
+		return DefaultUpdateInterval
+	}
+	return c.UpdateInterval
+}
+
+func (c *Config) maxResends() int {
+	if c == nil || c.MaxResends <= 0 {
+		return DefaultMaxResends
+	}
+	return c.MaxResends
+}
+
+func (c *Config) timeout() time.Duration {
+	if c == nil || c.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Config) pingInterval() time.Duration {
+	if c == nil || c.PingInterval <= 0 {
+		return DefaultPingInterval
+	}
+	return c.PingInterval
+}
+
+func (c *Config) maxSplitPools() int {
+	if c == nil || c.MaxSplitPools <= 0 {
+		return DefaultMaxSplitPools
+	}
+	return c.MaxSplitPools
+}
+
+func (c *Config) maxSplitCount() int {
+	if c == nil || c.MaxSplitCount <= 0 {
+		return DefaultMaxSplitCount
+	}
+	return c.MaxSplitCount
+}
+
+func (c *Config) maxSplitBytes() int {
+	if c == nil || c.MaxSplitBytes <= 0 {
+		return DefaultMaxSplitBytes
+	}
+	return c.MaxSplitBytes
+}
+
+func (c *Config) maxOrderBytes() int {
+	if c == nil || c.MaxOrderBytes <= 0 {
+		return DefaultMaxOrderBytes
+	}
+	return c.MaxOrderBytes
+}
+
+func (c *Config) splitTimeout() time.Duration {
+	if c == nil || c.SplitTimeout <= 0 {
+		return DefaultSplitTimeout
+	}
+	return c.SplitTimeout
+}
+
+func (c *Config) limiter() Limiter {
+	if c == nil || c.Limiter == nil {
+		return new(TokenBucket).Init(DefaultOfflineRate, DefaultOfflineBurst)
+	}
+	return c.Limiter
+}
+
+func (c *Config) maxBans() int {
+	if c == nil || c.MaxBans <= 0 {
+		return DefaultMaxBans
+	}
+	return c.MaxBans
+}
+
+func (c *Config) banDuration() time.Duration {
+	if c == nil || c.BanDuration <= 0 {
+		return DefaultBanDuration
+	}
+	return c.BanDuration
+}
+
+func (c *Config) shards() int {
+	if c == nil || c.Shards <= 0 {
+		return 1
+	}
+	return c.Shards
+}
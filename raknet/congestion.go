@@ -0,0 +1,89 @@
+package raknet
+
+import (
+	"time"
+)
+
+// CongestionController decides how many bytes of DataPackets can be in flight.
+// Session calls its methods as DataPackets are sent, acknowledged or lost,
+// and keeps new DataPackets in the send queue while the window is full.
+type CongestionController interface {
+	// Window returns the maximum number of unacknowledged bytes.
+	Window() int
+
+	// OnSend is called when a DataPacket of size bytes is sent with sequence number seq.
+	OnSend(seq uint32, size int)
+
+	// OnACK is called when a DataPacket of size bytes is acknowledged.
+	// rtt is the measured round trip time, or 0 if the DataPacket was a resend.
+	OnACK(size int, rtt time.Duration)
+
+	// OnLoss is called when a DataPacket with sequence number seq is lost.
+	// timeout is true if the loss is detected by retransmission timeout, false by NACK.
+	OnLoss(seq uint32, timeout bool)
+}
+
+// SlidingWindow is a CongestionController modeled on RakNet's sliding window algorithm.
+// The window starts from MTU and grows by MTU per ACK in slow start,
+// and by MTU*MTU/window per ACK in congestion avoidance.
+// The window is halved on NACK, and reset to MTU on retransmission timeout.
+// Losses of DataPackets sent before the last decrease are ignored,
+// so the window decreases at most once per round trip.
+type SlidingWindow struct {
+	MTU int
+
+	cwnd, ssthresh int
+	nextSeq        uint32
+	recoverSeq     uint32
+}
+
+func (w *SlidingWindow) init() {
+	if w.cwnd == 0 {
+		w.cwnd = w.MTU
+	}
+}
+
+// Window implements CongestionController.
+func (w *SlidingWindow) Window() int {
+	w.init()
+	return w.cwnd
+}
+
+// OnSend implements CongestionController.
+func (w *SlidingWindow) OnSend(seq uint32, size int) {
+	w.nextSeq = (seq + 1) & triadMask
+	// Keep recoverSeq close behind nextSeq, so that triadAhead does not take
+	// it as ahead of new losses after the sequence numbers move on far.
+	if (w.nextSeq-w.recoverSeq)&triadMask > (triadMask+1)/4 {
+		w.recoverSeq = (w.nextSeq - (triadMask+1)/4) & triadMask
+	}
+}
+
+// OnACK implements CongestionController.
+func (w *SlidingWindow) OnACK(size int, rtt time.Duration) {
+	w.init()
+	if w.ssthresh == 0 || w.cwnd < w.ssthresh {
+		w.cwnd += w.MTU
+	} else {
+		w.cwnd += w.MTU * w.MTU / w.cwnd
+	}
+}
+
+// OnLoss implements CongestionController.
+func (w *SlidingWindow) OnLoss(seq uint32, timeout bool) {
+	w.init()
+	if !triadAhead(seq, w.recoverSeq) {
+		return
+	}
+	w.recoverSeq = w.nextSeq
+
+	w.ssthresh = w.cwnd / 2
+	if w.ssthresh < w.MTU {
+		w.ssthresh = w.MTU
+	}
+	if timeout {
+		w.cwnd = w.MTU
+	} else {
+		w.cwnd = w.ssthresh
+	}
+}
@@ -0,0 +1,105 @@
+package raknet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	w := &SlidingWindow{MTU: 1000}
+	if w.Window() != 1000 {
+		t.Fatalf("Expected initial window 1000, got %d", w.Window())
+	}
+
+	for seq := uint32(0); seq < 4; seq++ {
+		w.OnSend(seq, 1000)
+		w.OnACK(1000, time.Millisecond)
+	}
+	if w.Window() != 5000 {
+		t.Fatalf("Expected window 5000 after slow start, got %d", w.Window())
+	}
+
+	w.OnSend(4, 1000)
+	w.OnSend(5, 1000)
+	w.OnLoss(4, false)
+	if w.Window() != 2500 {
+		t.Fatalf("Expected window 2500 after NACK, got %d", w.Window())
+	}
+	w.OnLoss(5, false)
+	if w.Window() != 2500 {
+		t.Fatalf("Expected window unchanged by loss in the same round trip, got %d", w.Window())
+	}
+
+	w.OnACK(1000, time.Millisecond)
+	if w.Window() != 2500+1000*1000/2500 {
+		t.Fatalf("Expected window %d in congestion avoidance, got %d", 2500+1000*1000/2500, w.Window())
+	}
+
+	w.OnSend(6, 1000)
+	w.OnLoss(6, true)
+	if w.Window() != 1000 {
+		t.Fatalf("Expected window 1000 after timeout, got %d", w.Window())
+	}
+}
+
+func TestSlidingWindowWrap(t *testing.T) {
+	type round struct {
+		send, loss []uint32
+	}
+	cases := []struct {
+		rounds []round
+		expect int
+	}{
+		{[]round{{[]uint32{triadMask - 1, triadMask, 0}, []uint32{triadMask - 1, 0}}}, 500},
+		{[]round{{[]uint32{triadMask - 1, triadMask}, []uint32{triadMask - 1}}, {[]uint32{0}, []uint32{0}}}, 250},
+		{[]round{{[]uint32{triadMask - 1<<22, triadMask}, []uint32{triadMask}}, {[]uint32{0, 1}, []uint32{triadMask, 1}}}, 250},
+		{[]round{{[]uint32{0}, []uint32{0}}, {[]uint32{1<<23 + 5}, []uint32{1<<23 + 5}}}, 250},
+	}
+
+	for i, c := range cases {
+		w := &SlidingWindow{MTU: 100}
+		w.cwnd = 1000
+		for _, r := range c.rounds {
+			for _, seq := range r.send {
+				w.OnSend(seq, 100)
+			}
+			for _, seq := range r.loss {
+				w.OnLoss(seq, false)
+			}
+		}
+		if w.Window() != c.expect {
+			t.Errorf("Test #%d: expected window %d, got %d", i, c.expect, w.Window())
+		}
+	}
+}
+
+func TestSessionCongestionQueue(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sess := new(Session).Init(conn, conn.LocalAddr().(*net.UDPAddr))
+	sess.MTU = 576
+	payload := make([]byte, 400)
+	for i := 0; i < 3; i++ {
+		if err := sess.SendEncapsulatedStream(bytes.NewReader(payload), reliable); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sess.recoveryPool) != 1 || sess.queued() != 2 {
+		t.Fatalf("Expected 1 DataPacket in flight and 2 queued, got %d, %d", len(sess.recoveryPool), sess.queued())
+	}
+
+	sess.HandleACK([]uint32{0})
+	if err := sess.FlushSendQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sess.recoveryPool) != 2 || sess.queued() != 0 || sess.inFlight != 2*(4+6+400) {
+		t.Errorf("Expected 2 DataPackets in flight after ACK, got %d(%d bytes), %d queued",
+			len(sess.recoveryPool), sess.inFlight, sess.queued())
+	}
+}
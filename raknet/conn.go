@@ -0,0 +1,197 @@
+package raknet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn wraps a connected Session to implement net.Conn.
+// Each Read returns exactly one received payload, and each Write
+// sends b as a single payload.
+// Conn.Init must be called once for initialization.
+type Conn struct {
+	sess *Session
+
+	// Option is a StreamOption used for Write.
+	// By default payloads are sent reliable ordered on channel 0.
+	Option *StreamOption
+
+	readDeadline, writeDeadline deadline
+}
+
+// Init initializes Conn with given Session.
+// Init returns the Conn itself, so we can define
+// Conn with new(Conn).Init(sess)
+func (c *Conn) Init(sess *Session) *Conn {
+	c.sess = sess
+	c.Option = &StreamOption{MessageIndex: true}
+	c.readDeadline.init()
+	c.writeDeadline.init()
+	return c
+}
+
+// Session returns the underlying Session.
+func (c *Conn) Session() *Session {
+	return c.sess
+}
+
+// Read reads a single payload into b.
+// If b is smaller than the payload, the rest of the payload is discarded
+// and Read returns io.ErrShortBuffer with truncated n.
+// Read returns io.EOF after the session is closed, or ErrTimeout
+// if remote stopped responding.
+func (c *Conn) Read(b []byte) (int, error) {
+	select {
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	select {
+	case p := <-c.sess.recv:
+		n := copy(b, p)
+		if n < len(p) {
+			return n, io.ErrShortBuffer
+		}
+		return n, nil
+	case <-c.sess.closed:
+		if err := c.sess.Err(); err == ErrTimeout {
+			return 0, err
+		}
+		return 0, io.EOF
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends b as a single payload with Option.
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.sess.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	if err := c.sess.SendEncapsulatedStream(bytes.NewReader(b), c.Option); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying Session.
+func (c *Conn) Close() error {
+	c.sess.Close()
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sess.ServerConn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.sess.Addr
+}
+
+// SetDeadline implements net.Conn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// NetListener wraps Listener to implement net.Listener.
+type NetListener struct {
+	*Listener
+}
+
+// Accept waits for and returns the next connected session as a Conn.
+func (l NetListener) Accept() (net.Conn, error) {
+	sess, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return new(Conn).Init(sess), nil
+}
+
+// deadline is a cancelable deadline which also applies to pending I/O.
+// It is closely modeled on the deadline of net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline is exceeded
+}
+
+func (d *deadline) init() {
+	d.cancel = make(chan struct{})
+}
+
+// set sets the point in time when the deadline will time out.
+// A zero value for t disables the deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel which is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,60 @@
+package raknet
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ln net.Listener = NetListener{l}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	sess, err := (&Config{HandshakeTimeout: 3 * time.Second}).Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client net.Conn = new(Conn).Init(sess)
+	defer client.Close()
+	server := <-accepted
+
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 16)); !os.IsTimeout(err) {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	client.SetReadDeadline(time.Time{})
+
+	for _, msg := range []string{"\xfefirst", "\xfesecond"} {
+		if _, err := server.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := make([]byte, 32)
+	for _, msg := range []string{"\xfefirst", "\xfesecond"} {
+		n, err := client.Read(b)
+		if err != nil || string(b[:n]) != msg {
+			t.Fatalf("Expected %q, got %q(error %v)", msg, b[:n], err)
+		}
+	}
+
+	if _, err := server.Write([]byte("\xfetoo long")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Read(b[:3]); n != 3 || err == nil {
+		t.Errorf("Expected truncated read with error, got n=%d, error %v", n, err)
+	}
+}
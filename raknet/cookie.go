@@ -0,0 +1,153 @@
+package raknet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"github.com/cr0sh/encore/util/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// cookieRotation is an interval of rotating the cookie secret.
+// Cookies issued with the previous secret are still accepted.
+const cookieRotation = time.Minute
+
+// errInvalidCookie is returned when OpenConnectionRequest2 has a wrong cookie.
+var errInvalidCookie = errors.New("raknet: invalid security cookie")
+
+// cookieJar issues and verifies cookies, which are HMACs of
+// client addresses with a rotating secret.
+type cookieJar struct {
+	secret, prev [32]byte
+	rotated      time.Time
+}
+
+// rotate renews the secret if cookieRotation has passed.
+func (j *cookieJar) rotate(now time.Time) {
+	if !j.rotated.IsZero() && now.Sub(j.rotated) < cookieRotation {
+		return
+	}
+	j.prev = j.secret
+	if _, err := rand.Read(j.secret[:]); err != nil {
+		panic(err)
+	}
+	if j.rotated.IsZero() {
+		j.prev = j.secret
+	}
+	j.rotated = now
+}
+
+func cookie(secret []byte, addr *net.UDPAddr) uint32 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(addr.String()))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+// issue returns a cookie for addr.
+func (j *cookieJar) issue(addr *net.UDPAddr, now time.Time) uint32 {
+	j.rotate(now)
+	return cookie(j.secret[:], addr)
+}
+
+// verify reports whether c is a cookie issued for addr
+// with the current or previous secret.
+func (j *cookieJar) verify(addr *net.UDPAddr, c uint32, now time.Time) bool {
+	j.rotate(now)
+	return c == cookie(j.secret[:], addr) || c == cookie(j.prev[:], addr)
+}
+
+// MarshalStream implements Stream Marshaler interface.
+func (pk OpenConnectionReply1) MarshalStream(wr io.Writer) error {
+	b := make([]byte, 0, len(OFFLINE_MESSAGE_DATA_ID)+15)
+	b = append(b, OFFLINE_MESSAGE_DATA_ID...)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[len(b)-8:], pk.ServerGUID)
+	if pk.Security {
+		b = append(b, 1, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], pk.Cookie)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(b, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], pk.MTU)
+	_, err := wr.Write(b)
+	return err
+}
+
+// UnmarshalStream implements Stream Unmarshaler interface.
+func (pk *OpenConnectionReply1) UnmarshalStream(rd io.Reader) error {
+	if err := pk.OfflineMsg.UnmarshalStream(rd); err != nil {
+		return err
+	}
+	b := make([]byte, 9)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return err
+	}
+	pk.ServerGUID = binary.BigEndian.Uint64(b[:8])
+	pk.Security = b[8] != 0
+	if pk.Security {
+		if _, err := io.ReadFull(rd, b[:4]); err != nil {
+			return err
+		}
+		pk.Cookie = binary.BigEndian.Uint32(b[:4])
+	}
+	if _, err := io.ReadFull(rd, b[:2]); err != nil {
+		return err
+	}
+	pk.MTU = binary.BigEndian.Uint16(b[:2])
+	return nil
+}
+
+// MarshalStream implements Stream Marshaler interface.
+// If Security is set, the cookie is followed by a false flag of
+// the client challenge, which is not supported.
+func (pk OpenConnectionRequest2) MarshalStream(wr io.Writer) error {
+	b := make([]byte, 0, len(OFFLINE_MESSAGE_DATA_ID)+5)
+	b = append(b, OFFLINE_MESSAGE_DATA_ID...)
+	if pk.Security {
+		b = append(b, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-5:], pk.Cookie)
+	}
+	if _, err := wr.Write(b); err != nil {
+		return err
+	}
+	if err := pk.RemoteAddr.MarshalStream(wr); err != nil {
+		return err
+	}
+
+	b = make([]byte, 10)
+	binary.BigEndian.PutUint16(b[:2], pk.MTU)
+	binary.BigEndian.PutUint64(b[2:], pk.ClientGUID)
+	_, err := wr.Write(b)
+	return err
+}
+
+// UnmarshalStream implements Stream Unmarshaler interface.
+// Security must be set before calling UnmarshalStream.
+func (pk *OpenConnectionRequest2) UnmarshalStream(rd io.Reader) error {
+	if err := pk.OfflineMsg.UnmarshalStream(rd); err != nil {
+		return err
+	}
+	b := make([]byte, 10)
+	if pk.Security {
+		if _, err := io.ReadFull(rd, b[:5]); err != nil {
+			return err
+		}
+		pk.Cookie = binary.BigEndian.Uint32(b[:4])
+		if b[4] != 0 {
+			return errors.New("raknet: client challenge is not supported")
+		}
+	}
+	if err := pk.RemoteAddr.UnmarshalStream(rd); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return err
+	}
+	pk.MTU = binary.BigEndian.Uint16(b[:2])
+	pk.ClientGUID = binary.BigEndian.Uint64(b[2:])
+	return nil
+}
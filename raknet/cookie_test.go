@@ -0,0 +1,101 @@
+package raknet
+
+import (
+	"bytes"
+	"github.com/cr0sh/encore/util/binary"
+	"github.com/cr0sh/encore/util/packet"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCookieJar(t *testing.T) {
+	var jar cookieJar
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 19132}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 19133}
+	now := time.Now()
+
+	c := jar.issue(a, now)
+	if !jar.verify(a, c, now) || jar.verify(b, c, now) {
+		t.Fatal("Expected cookie valid only for the issued address")
+	}
+	now = now.Add(cookieRotation)
+	if !jar.verify(a, c, now) {
+		t.Error("Expected cookie of the previous secret valid")
+	}
+	now = now.Add(cookieRotation)
+	if jar.verify(a, c, now) {
+		t.Error("Expected cookie expired after two rotations")
+	}
+}
+
+func TestMarshalSecurity(t *testing.T) {
+	cases := []packet.Packet{
+		&OpenConnectionReply1{ServerGUID: 1, MTU: 1492},
+		&OpenConnectionReply1{ServerGUID: 1, Security: true, Cookie: 0xdeadbeef, MTU: 1492},
+		&OpenConnectionRequest2{RemoteAddr: IPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 19132}, MTU: 1492, ClientGUID: 2},
+		&OpenConnectionRequest2{Security: true, Cookie: 0xdeadbeef,
+			RemoteAddr: IPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 19132}, MTU: 1492, ClientGUID: 2},
+	}
+
+	for i, c := range cases {
+		buf := new(bytes.Buffer)
+		if err := packet.Marshal(c, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded packet.Packet
+		switch pk := c.(type) {
+		case *OpenConnectionReply1:
+			decoded = new(OpenConnectionReply1)
+		case *OpenConnectionRequest2:
+			decoded = &OpenConnectionRequest2{Security: pk.Security}
+		}
+		if err := binary.Unmarshal(decoded, bytes.NewReader(buf.Bytes()[1:])); err != nil {
+			t.Fatal(err)
+		}
+		if pk, ok := decoded.(*OpenConnectionRequest2); ok {
+			pk.RemoteAddr.IP = pk.RemoteAddr.IP.To4()
+		}
+		if !reflect.DeepEqual(decoded, c) {
+			t.Errorf("Test #%d: expected %+v, got %+v", i, c, decoded)
+		}
+	}
+}
+
+func TestListenerCookie(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := new(bytes.Buffer)
+	if err := packet.Marshal(&OpenConnectionRequest2{
+		Security:   true,
+		Cookie:     0xdeadbeef,
+		RemoteAddr: IPAddr(*l.Addr().(*net.UDPAddr)),
+		MTU:        1492,
+		ClientGUID: 1,
+	}, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, maxDatagramSize)); err == nil {
+		t.Error("Expected no reply for an invalid cookie")
+	}
+	if sess := l.shards[0].session(conn.LocalAddr().(*net.UDPAddr)); sess != nil {
+		t.Error("Expected no session created for an invalid cookie")
+	}
+}
@@ -2,7 +2,6 @@ package raknet
 
 import (
 	"github.com/cr0sh/encore/util/binary"
-	log "github.com/sirupsen/logrus"
 	"io"
 )
 
@@ -22,6 +21,9 @@ type EncapsulatedPacket struct {
 	OrderChannel byte
 
 	Payload []byte
+
+	// receipt is a local receipt ID for Session.SendWithReceipt, not sent on the wire.
+	receipt uint32
 }
 
 func (ep EncapsulatedPacket) headLen() (length int) {
@@ -47,51 +49,49 @@ func (ep EncapsulatedPacket) Len() int {
 }
 
 // MarshalStream implements Stream Marshaler interface.
-func (ep EncapsulatedPacket) MarshalStream(wr io.Writer) (err error) {
+func (ep EncapsulatedPacket) MarshalStream(wr io.Writer) error {
+	_, err := wr.Write(ep.Append(nil))
+	return err
+}
+
+// Append appends the encoded EncapsulatedPacket to b and returns the extended buffer.
+func (ep *EncapsulatedPacket) Append(b []byte) []byte {
 	flag := ep.Reliability << 5
 	if ep.IsSplit {
 		flag |= (1 << 4)
 	}
 
-	buf := make([]byte, 3, 20)
+	var buf []byte
+	b, buf = grow(b, ep.headLen())
 	buf[0] = flag
 	binary.BigEndian.PutUint16(buf[1:3], uint16(len(ep.Payload)<<3))
+	buf = buf[3:]
 
 	if ep.Reliability > 0 {
 		if ep.Reliability >= 2 && ep.Reliability != 5 {
-			b := make([]byte, 3)
-			binary.LittleEndian.PutTriad(b, ep.MessageIndex)
-			buf = append(buf, b...)
+			binary.LittleEndian.PutTriad(buf, ep.MessageIndex)
+			buf = buf[3:]
 		}
 		if ep.Reliability <= 4 && ep.Reliability != 2 {
-			b := make([]byte, 4)
-			binary.LittleEndian.PutTriad(b, ep.OrderIndex)
-			b[3] = ep.OrderChannel
-			buf = append(buf, b...)
+			binary.LittleEndian.PutTriad(buf, ep.OrderIndex)
+			buf[3] = ep.OrderChannel
+			buf = buf[4:]
 		}
 	}
 
 	if ep.IsSplit {
-		b := make([]byte, 10)
-		binary.BigEndian.PutUint32(b, ep.SplitCount)
-		binary.BigEndian.PutUint16(b[4:], ep.SplitID)
-		binary.BigEndian.PutUint32(b[6:], ep.SplitIndex)
-		buf = append(buf, b...)
+		binary.BigEndian.PutUint32(buf, ep.SplitCount)
+		binary.BigEndian.PutUint16(buf[4:], ep.SplitID)
+		binary.BigEndian.PutUint32(buf[6:], ep.SplitIndex)
 	}
 
-	if ep.headLen() != len(buf) {
-		log.WithFields(log.Fields{ // TODO: Remove this
-			"expected": ep.headLen(),
-			"real":     len(buf),
-		}).Warn("Incorrect EncapsulatedPacket header length")
-	}
-
-	if _, err = wr.Write(buf); err != nil {
-		return
-	}
+	return append(b, ep.Payload...)
+}
 
-	_, err = wr.Write(ep.Payload)
-	return
+// grow extends b by n bytes, and returns the extended buffer and the new bytes.
+func grow(b []byte, n int) ([]byte, []byte) {
+	b = append(b, make([]byte, n)...)
+	return b, b[len(b)-n:]
 }
 
 // UnmarshalStream implements Stream Unmarshaler interface.
@@ -138,6 +138,48 @@ func (ep *EncapsulatedPacket) UnmarshalStream(rd io.Reader) (err error) {
 	return
 }
 
+// Decode decodes an EncapsulatedPacket from the head of b, and returns
+// the number of bytes decoded. Unlike UnmarshalStream, Decode does not copy
+// the payload: ep.Payload is a slice of b, valid only while b is not reused.
+func (ep *EncapsulatedPacket) Decode(b []byte) (int, error) {
+	if len(b) < 3 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	ep.Reliability = b[0] >> 5
+	ep.IsSplit = b[0]&(1<<4) > 0
+
+	payloadLen := int(binary.BigEndian.Uint16(b[1:3]) >> 3)
+	if b[2]&7 != 0 {
+		payloadLen++
+	}
+
+	n := ep.headLen()
+	if len(b) < n+payloadLen {
+		return 0, io.ErrUnexpectedEOF
+	}
+	head := b[3:n]
+	if ep.Reliability > 0 {
+		if ep.Reliability >= 2 && ep.Reliability != 5 {
+			ep.MessageIndex = binary.LittleEndian.Triad(head)
+			head = head[3:]
+		}
+		if ep.Reliability <= 4 && ep.Reliability != 2 {
+			ep.OrderIndex = binary.LittleEndian.Triad(head)
+			ep.OrderChannel = head[3]
+			head = head[4:]
+		}
+	}
+
+	if ep.IsSplit {
+		ep.SplitCount = binary.BigEndian.Uint32(head[:4])
+		ep.SplitID = binary.BigEndian.Uint16(head[4:6])
+		ep.SplitIndex = binary.BigEndian.Uint32(head[6:10])
+	}
+
+	ep.Payload = b[n : n+payloadLen : n+payloadLen]
+	return n + payloadLen, nil
+}
+
 // DataPacket is a set of EncapsulatedPackets with sequence number used in MCPE protocols.
 type DataPacket struct {
 	Seq     binary.LTriad
@@ -145,18 +187,21 @@ type DataPacket struct {
 }
 
 // MarshalStream implements Stream Marshaler interface.
-func (dp DataPacket) MarshalStream(wr io.Writer) (err error) {
-	b := make([]byte, 3)
-	binary.LittleEndian.PutTriad(b, uint32(dp.Seq))
-	if _, err = wr.Write(b); err != nil {
-		return
-	}
+func (dp DataPacket) MarshalStream(wr io.Writer) error {
+	_, err := wr.Write(dp.Append(nil))
+	return err
+}
+
+// Append appends the encoded DataPacket, without the datagram flags,
+// to b and returns the extended buffer.
+func (dp *DataPacket) Append(b []byte) []byte {
+	var seq []byte
+	b, seq = grow(b, 3)
+	binary.LittleEndian.PutTriad(seq, uint32(dp.Seq))
 	for i := range dp.Packets {
-		if err = dp.Packets[i].MarshalStream(wr); err != nil {
-			return err
-		}
+		b = dp.Packets[i].Append(b)
 	}
-	return nil
+	return b
 }
 
 // UnmarshalStream implements Stream Unmarshaler interface.
@@ -185,3 +230,28 @@ func (dp *DataPacket) UnmarshalStream(rd io.Reader) (err error) {
 
 	return nil
 }
+
+// Decode decodes a DataPacket from b, reusing dp.Packets.
+// Payloads of the decoded packets are slices of b, so they are valid only
+// while b is not reused. Copy the payloads to retain them.
+func (dp *DataPacket) Decode(b []byte) error {
+	if len(b) < 3 {
+		return io.ErrUnexpectedEOF
+	}
+	dp.Seq = binary.LTriad(binary.LittleEndian.Triad(b))
+	dp.Packets = dp.Packets[:0]
+
+	for b = b[3:]; len(b) > 0; {
+		var ep EncapsulatedPacket
+		n, err := ep.Decode(b)
+		if err != nil {
+			return err
+		}
+		if len(ep.Payload) == 0 {
+			break // see UnmarshalStream
+		}
+		dp.Packets = append(dp.Packets, ep)
+		b = b[n:]
+	}
+	return nil
+}
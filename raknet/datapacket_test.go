@@ -123,8 +123,17 @@ func TestUnmarshalEncapsulatedPacket(t *testing.T) {
 			t.Errorf("Test #%d: Expected %v,\nGot %v", i, c.expect, ep)
 			return
 		}
-	}
 
+		ep = EncapsulatedPacket{}
+		if n, err := ep.Decode(c.payload); err != nil || n != len(c.payload) {
+			t.Errorf("Test #%d: Decode returned %d, error %v", i, n, err)
+		} else if !reflect.DeepEqual(c.expect, ep) {
+			t.Errorf("Test #%d: Expected %v from Decode,\nGot %v", i, c.expect, ep)
+		}
+		if n, err := ep.Decode(c.payload[:len(c.payload)-1]); err == nil {
+			t.Errorf("Test #%d: Expected error decoding a truncated packet, got %d", i, n)
+		}
+	}
 }
 
 func TestMarshalDataPacket(t *testing.T) {
@@ -152,3 +161,61 @@ func TestMarshalDataPacket(t *testing.T) {
 		}
 	}
 }
+
+// benchmarkDataPacket is a DataPacket of a typical reliable ordered stream.
+var benchmarkDataPacket = DataPacket{
+	Seq: 12345,
+	Packets: []EncapsulatedPacket{
+		{Reliability: 3, MessageIndex: 10, OrderIndex: 5, Payload: make([]byte, 500)},
+		{Reliability: 3, MessageIndex: 11, OrderIndex: 6, Payload: make([]byte, 500)},
+		{Reliability: 0, Payload: make([]byte, 100)},
+	},
+}
+
+func TestDataPacketAllocs(t *testing.T) {
+	var dp DataPacket
+	b := benchmarkDataPacket.Append(nil)
+	if err := dp.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(benchmarkDataPacket, dp) {
+		t.Fatalf("Expected %v,\nGot %v", benchmarkDataPacket, dp)
+	}
+
+	if n := testing.AllocsPerRun(100, func() {
+		buf := getBuffer()
+		*buf = benchmarkDataPacket.Append(append(*buf, 0x84))
+		dp.Decode((*buf)[1:])
+		putBuffer(buf)
+	}); n != 0 {
+		t.Errorf("Expected no allocations, got %v", n)
+	}
+}
+
+func BenchmarkDataPacketAppend(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := getBuffer()
+		*buf = benchmarkDataPacket.Append(append(*buf, 0x84))
+		putBuffer(buf)
+	}
+}
+
+func BenchmarkDataPacketDecode(b *testing.B) {
+	b.ReportAllocs()
+	buf := benchmarkDataPacket.Append(nil)
+	var dp DataPacket
+	for i := 0; i < b.N; i++ {
+		if err := dp.Decode(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDataPacketMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		binary.Marshal(benchmarkDataPacket, buf)
+	}
+}
@@ -0,0 +1,268 @@
+package raknet
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cr0sh/encore/util/binary"
+	"github.com/cr0sh/encore/util/packet"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ProtocolVersion is a raknet protocol version sent with OpenConnectionRequest1.
+const ProtocolVersion = 8
+
+// retryInterval is an interval for resending offline handshake packets.
+const retryInterval = 500 * time.Millisecond
+
+var (
+	// ErrHandshakeTimeout is returned when the server does not finish
+	// the connection handshake in Config.HandshakeTimeout.
+	ErrHandshakeTimeout = errors.New("raknet: handshake timed out")
+
+	// ErrConnectionBanned is returned when the server replied ConnectionBanned.
+	ErrConnectionBanned = errors.New("raknet: banned by server")
+
+	// ErrIncompatibleProtocol is returned when the server replied IncompatibleProtocolVersion.
+	ErrIncompatibleProtocol = errors.New("raknet: incompatible protocol version")
+
+	// ErrAlreadyConnected is returned when the server replied AlreadyConnected.
+	ErrAlreadyConnected = errors.New("raknet: already connected")
+
+	// ErrNoFreeConnections is returned when the server replied NoFreeIncomingConnections.
+	ErrNoFreeConnections = errors.New("raknet: no free incoming connections")
+
+	// ErrConnectionRequestFailed is returned when the server rejected the connection request.
+	ErrConnectionRequestFailed = errors.New("raknet: connection request failed")
+)
+
+// offlineErrors maps offline packet IDs replied on failure to errors.
+var offlineErrors = map[byte]error{
+	0x11: ErrConnectionRequestFailed,
+	0x12: ErrAlreadyConnected,
+	0x14: ErrNoFreeConnections,
+	0x17: ErrConnectionBanned,
+	0x19: ErrIncompatibleProtocol,
+}
+
+// Dial connects to the raknet server at address with default Config.
+func Dial(address string) (*Session, error) {
+	return new(Config).Dial(address)
+}
+
+// Dial connects to the raknet server at address, and returns a Session
+// which finished the connection handshake(Status 3).
+func (c *Config) Dial(address string) (*Session, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.DialConn(conn, addr)
+}
+
+// DialConn connects to the raknet server at addr over conn, and returns a Session
+// which finished the connection handshake(Status 3).
+// The session owns conn: conn is closed when the handshake fails or the session is closed.
+func (c *Config) DialConn(conn net.PacketConn, addr *net.UDPAddr) (*Session, error) {
+	d := &dialer{
+		config:   c,
+		conn:     conn,
+		addr:     addr,
+		deadline: time.Now().Add(c.handshakeTimeout()),
+		guid:     rand.Uint64(),
+		buf:      make([]byte, maxDatagramSize),
+	}
+	sess, err := d.handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sess.onClose = func(err error) {
+		conn.Close()
+	}
+	go runClient(conn, sess)
+	return sess, nil
+}
+
+// dialer holds states of a client-side handshake.
+type dialer struct {
+	config   *Config
+	conn     net.PacketConn
+	addr     *net.UDPAddr
+	deadline time.Time
+	guid     uint64
+	buf      []byte
+}
+
+func (d *dialer) handshake() (*Session, error) {
+	mtu, reply1, err := d.discoverMTU()
+	if err != nil {
+		return nil, err
+	}
+	if int(reply1.MTU) < mtu {
+		mtu = int(reply1.MTU)
+	}
+
+	b, err := d.request(&OpenConnectionRequest2{
+		Security:   reply1.Security,
+		Cookie:     reply1.Cookie,
+		RemoteAddr: IPAddr(*d.addr),
+		MTU:        uint16(mtu),
+		ClientGUID: d.guid,
+	}, 0x08, 0)
+	if err != nil {
+		return nil, err
+	}
+	reply2 := new(OpenConnectionReply2)
+	if err := binary.Unmarshal(reply2, bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+
+	sess := new(Session).Init(d.conn, d.addr)
+	sess.config = d.config
+	sess.ID = d.guid
+	sess.client = true
+	sess.MTU = d.config.clampMTU(int(reply2.MTU))
+	sess.Status = 2
+
+	if err := sess.SendPacket(&ConnectionRequest{
+		ClientGUID:   d.guid,
+		SendPingTime: sess.timestamp(),
+	}, reliable); err != nil {
+		return nil, err
+	}
+
+	for sess.Status != 3 {
+		now := time.Now()
+		if !now.Before(d.deadline) {
+			return nil, ErrHandshakeTimeout
+		}
+		if err := sess.Update(now); err != nil {
+			return nil, err
+		}
+
+		next := now.Add(d.config.updateInterval())
+		if next.After(d.deadline) {
+			next = d.deadline
+		}
+		d.conn.SetReadDeadline(next)
+		n, addr, err := d.conn.ReadFrom(d.buf)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		if n == 0 || d.buf[0]&0x80 == 0 || !sameAddr(addr, d.addr) {
+			continue
+		}
+
+		if err := sess.HandlePacket(d.buf[:n]); err != nil {
+			return nil, err
+		}
+		if err := sess.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := sess.Update(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// request sends given offline packet repeatedly until a reply with replyID
+// arrives, and returns the reply without its ID. If attempts is positive,
+// request gives up with ErrHandshakeTimeout after sending the packet attempts times.
+func (d *dialer) request(pk packet.Packet, replyID byte, attempts int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := packet.Marshal(pk, buf); err != nil {
+		return nil, err
+	}
+
+	for i := 0; (attempts <= 0 || i < attempts) && time.Now().Before(d.deadline); i++ {
+		if _, err := d.conn.WriteTo(buf.Bytes(), d.addr); err != nil {
+			return nil, err
+		}
+
+		retry := time.Now().Add(retryInterval)
+		if retry.After(d.deadline) {
+			retry = d.deadline
+		}
+		d.conn.SetReadDeadline(retry)
+		for {
+			n, addr, err := d.conn.ReadFrom(d.buf)
+			if err != nil {
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n == 0 || !sameAddr(addr, d.addr) {
+				continue
+			}
+			if d.buf[0] == replyID {
+				return d.buf[1:n], nil
+			}
+			if err, ok := offlineErrors[d.buf[0]]; ok {
+				return nil, err
+			}
+		}
+	}
+	return nil, ErrHandshakeTimeout
+}
+
+// runClient reads datagrams from conn and passes them to sess until conn is closed.
+func runClient(conn net.PacketConn, sess *Session) {
+	r := newBatchReader(conn)
+	interval := sess.config.updateInterval()
+	next := time.Now().Add(interval)
+	conn.SetReadDeadline(next)
+	for {
+		msgs, err := r.read()
+		if now := time.Now(); !now.Before(next) {
+			if err := sess.Update(now); err != nil {
+				log.WithError(err).Debug("Failed to update session")
+			}
+			next = now.Add(interval)
+			conn.SetReadDeadline(next)
+		}
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithError(err).Warn("Failed to read from client socket")
+			continue
+		}
+		for _, m := range msgs {
+			b := m.Buffers[0][:m.N]
+			if m.N == 0 || b[0]&0x80 == 0 || !sameAddr(m.Addr, sess.Addr) {
+				continue
+			}
+
+			if err := sess.HandlePacket(b); err != nil {
+				log.WithFields(log.Fields{
+					"addr":  m.Addr,
+					"error": err,
+				}).Debug("Failed to handle datagram")
+			}
+		}
+	}
+}
+
+func sameAddr(a net.Addr, b *net.UDPAddr) bool {
+	if a, ok := a.(*net.UDPAddr); ok {
+		return a.Port == b.Port && a.IP.Equal(b.IP)
+	}
+	return a.String() == b.String()
+}
@@ -0,0 +1,174 @@
+package raknet
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultOfflineRate is a number of offline packets allowed per second
+	// for each IP when Config.Limiter is not set.
+	DefaultOfflineRate = 10
+
+	// DefaultOfflineBurst is a burst size of offline packets for each IP
+	// when Config.Limiter is not set.
+	DefaultOfflineBurst = 20
+
+	// DefaultBanDuration is used when Config.BanDuration is not set.
+	DefaultBanDuration = 30 * time.Second
+
+	// DefaultMaxBuckets is used when TokenBucket.MaxBuckets is not set.
+	DefaultMaxBuckets = 1 << 16
+
+	// DefaultMaxBans is used when Config.MaxBans is not set.
+	DefaultMaxBans = 1 << 16
+)
+
+// Limiter decides whether an offline packet from ip is handled.
+// Allow may be called concurrently by shards of Listener.
+type Limiter interface {
+	Allow(ip net.IP, now time.Time) bool
+}
+
+// TokenBucket is a Limiter with a token bucket for each IP.
+// Buckets are refilled by Rate tokens per second up to Burst tokens.
+// A TokenBucket with Rate and Burst set is ready to use without Init.
+//
+// At most MaxBuckets IPs have their own bucket, so that packets from
+// spoofed addresses do not grow it without limit. Other IPs share a bucket
+// until full buckets are removed.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+
+	// MaxBuckets is the number of IPs tracked. Zero means DefaultMaxBuckets.
+	MaxBuckets int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	shared    bucket // used by IPs over MaxBuckets
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketSweepInterval is an interval of removing full buckets.
+const tokenBucketSweepInterval = time.Minute
+
+// Init initializes TokenBucket.
+func (tb *TokenBucket) Init(rate float64, burst int) *TokenBucket {
+	tb.Rate = rate
+	tb.Burst = burst
+	tb.buckets = make(map[string]*bucket)
+	return tb
+}
+
+// Allow implements Limiter. It takes a token from the bucket of ip if any.
+func (tb *TokenBucket) Allow(ip net.IP, now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.buckets == nil {
+		tb.buckets = make(map[string]*bucket)
+	}
+	if now.Sub(tb.lastSweep) >= tokenBucketSweepInterval {
+		tb.sweep(now)
+	}
+
+	burst := float64(tb.Burst)
+	key := ip.String()
+	b, ok := tb.buckets[key]
+	if !ok && len(tb.buckets) >= tb.maxBuckets() {
+		b = &tb.shared
+		if b.last.IsZero() {
+			b.tokens, b.last = burst, now
+		}
+	} else if !ok {
+		b = &bucket{tokens: burst, last: now}
+		tb.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * tb.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (tb *TokenBucket) maxBuckets() int {
+	if tb.MaxBuckets <= 0 {
+		return DefaultMaxBuckets
+	}
+	return tb.MaxBuckets
+}
+
+// sweep removes buckets which are refilled to Burst, as they are
+// the same as new ones.
+func (tb *TokenBucket) sweep(now time.Time) {
+	tb.lastSweep = now
+	for key, b := range tb.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*tb.Rate >= float64(tb.Burst) {
+			delete(tb.buckets, key)
+		}
+	}
+}
+
+// banList is a set of temporarily banned IPs with expiry.
+// If more than max IPs are banned, the oldest bans are lifted.
+type banList struct {
+	max    int
+	expiry map[string]time.Time
+	queue  []banEntry // in order of banning
+}
+
+type banEntry struct {
+	key    string
+	expiry time.Time
+}
+
+func newBanList(max int) *banList {
+	return &banList{max: max, expiry: make(map[string]time.Time)}
+}
+
+// ban bans ip until the expiry.
+func (bl *banList) ban(ip net.IP, expiry time.Time) {
+	key := ip.String()
+	bl.expiry[key] = expiry
+	bl.queue = append(bl.queue, banEntry{key, expiry})
+	for len(bl.expiry) > bl.max {
+		bl.pop()
+	}
+}
+
+// pop lifts the oldest ban, unless the IP is banned again after it.
+func (bl *banList) pop() {
+	e := bl.queue[0]
+	bl.queue[0] = banEntry{}
+	bl.queue = bl.queue[1:]
+	if expiry, ok := bl.expiry[e.key]; ok && expiry.Equal(e.expiry) {
+		delete(bl.expiry, e.key)
+	}
+}
+
+// banned reports whether ip is banned at now.
+func (bl *banList) banned(ip net.IP, now time.Time) bool {
+	expiry, ok := bl.expiry[ip.String()]
+	return ok && now.Before(expiry)
+}
+
+// expire removes expired bans. Bans expire in order of banning,
+// as they have the same duration.
+func (bl *banList) expire(now time.Time) {
+	for len(bl.queue) > 0 && !now.Before(bl.queue[0].expiry) {
+		bl.pop()
+	}
+}
@@ -0,0 +1,198 @@
+package raknet
+
+import (
+	"bytes"
+	"github.com/cr0sh/encore/util/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	a, b := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	cases := []struct {
+		ip     net.IP
+		after  time.Duration
+		expect bool
+	}{
+		{a, 0, true},
+		{a, 0, true},
+		{a, 0, true},
+		{a, 0, false},
+		{b, 0, true},
+		{a, 250 * time.Millisecond, false},
+		{a, 250 * time.Millisecond, true},
+		{a, 0, false},
+		{a, time.Hour, true},
+	}
+	// TokenBucket is usable with or without Init.
+	for j, tb := range []*TokenBucket{new(TokenBucket).Init(2, 3), {Rate: 2, Burst: 3}} {
+		now := time.Now()
+		for i, c := range cases {
+			now = now.Add(c.after)
+			if ok := tb.Allow(c.ip, now); ok != c.expect {
+				t.Errorf("Bucket #%d, Test #%d: expected %v, got %v", j, i, c.expect, ok)
+			}
+		}
+
+		tb.sweep(now.Add(time.Hour))
+		if len(tb.buckets) != 0 {
+			t.Errorf("Bucket #%d: expected full buckets removed, got %d", j, len(tb.buckets))
+		}
+	}
+}
+
+func TestTokenBucketLimit(t *testing.T) {
+	tb := &TokenBucket{Rate: 0, Burst: 1, MaxBuckets: 2}
+	now := time.Now()
+
+	cases := []struct {
+		ip     net.IP
+		expect bool
+	}{
+		{net.IPv4(10, 0, 0, 1), true},
+		{net.IPv4(10, 0, 0, 2), true},
+		{net.IPv4(10, 0, 0, 3), true}, // the shared bucket
+		{net.IPv4(10, 0, 0, 4), false},
+		{net.IPv4(10, 0, 0, 3), false},
+	}
+	for i, c := range cases {
+		if ok := tb.Allow(c.ip, now); ok != c.expect {
+			t.Errorf("Test #%d: expected %v, got %v", i, c.expect, ok)
+		}
+	}
+	if len(tb.buckets) != 2 {
+		t.Errorf("Expected 2 buckets, got %d", len(tb.buckets))
+	}
+}
+
+func TestBanList(t *testing.T) {
+	bl := newBanList(2)
+	now := time.Now()
+	ips := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}
+	for i, ip := range ips {
+		bl.ban(ip, now.Add(time.Duration(i+1)*time.Second))
+	}
+
+	cases := []struct {
+		after  time.Duration
+		expect []bool // banned of ips
+	}{
+		{0, []bool{false, true, true}},
+		{2 * time.Second, []bool{false, false, true}},
+		{3 * time.Second, []bool{false, false, false}},
+	}
+	for i, c := range cases {
+		bl.expire(now.Add(c.after))
+		for j, ip := range ips {
+			if banned := bl.banned(ip, now.Add(c.after)); banned != c.expect[j] {
+				t.Errorf("Test #%d: expected banned(%v) %v, got %v", i, ip, c.expect[j], banned)
+			}
+		}
+	}
+	if len(bl.expiry) != 0 || len(bl.queue) != 0 {
+		t.Errorf("Expected all bans expired, got %v", bl.expiry)
+	}
+}
+
+func TestListenerBan(t *testing.T) {
+	config := &Config{Limiter: new(TokenBucket).Init(0, 5), BanDuration: time.Hour}
+	l, err := config.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ping := new(bytes.Buffer)
+	if err := packet.Marshal(&UnconnectedPing{PingID: 1234}, ping); err != nil {
+		t.Fatal(err)
+	}
+	malformed := append([]byte{0x01}, make([]byte, 24)...)
+	ack := new(bytes.Buffer)
+	ack.WriteByte(0xc0)
+	EncodeACK(ACKMap{0: {}}, ack)
+
+	cases := []struct {
+		b      []byte
+		expect byte // 0 if no reply is expected
+	}{
+		{ack.Bytes(), 0},  // a late ACK of a closed session is dropped
+		{[]byte{0x42}, 0}, // unknown packets are ignored without a ban
+		{ping.Bytes(), 0x1c},
+		{malformed, 0},
+		{ping.Bytes(), 0x17},
+		{ping.Bytes(), 0x17},
+		{ping.Bytes(), 0},
+	}
+
+	b := make([]byte, maxDatagramSize)
+	for i, c := range cases {
+		if _, err := conn.Write(c.b); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(b)
+		if c.expect == 0 {
+			if err == nil {
+				t.Errorf("Test #%d: expected no reply, got ID 0x%x", i, b[0])
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test #%d: %v", i, err)
+		}
+		if n == 0 || b[0] != c.expect {
+			t.Errorf("Test #%d: expected ID 0x%x, got 0x%x", i, c.expect, b[0])
+		}
+	}
+}
+
+func TestShardBan(t *testing.T) {
+	conns := make([]net.PacketConn, 2)
+	for i := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	l := (&Config{BanDuration: time.Hour}).Serve(conns[0], conns[1])
+	defer l.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Banned by the first shard, the address gets ConnectionBanned from the second one.
+	malformed := append([]byte{0x01}, make([]byte, 24)...)
+	if _, err := conn.WriteTo(malformed, conns[0].LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ping := new(bytes.Buffer)
+	if err := packet.Marshal(&UnconnectedPing{PingID: 1234}, ping); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(ping.Bytes(), conns[1].LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || b[0] != 0x17 {
+		t.Errorf("Expected ConnectionBanned, got ID 0x%x", b[0])
+	}
+}
@@ -0,0 +1,490 @@
+package raknet
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cr0sh/encore/util/binary"
+	"github.com/cr0sh/encore/util/packet"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxDatagramSize is a size of the read buffer for incoming datagrams.
+	maxDatagramSize = 2048
+
+	// acceptBacklog is a number of connected sessions waiting for Accept.
+	acceptBacklog = 64
+)
+
+// ErrListenerClosed is returned when accepting from a closed Listener.
+var ErrListenerClosed = errors.New("raknet: listener closed")
+
+// Listener is a raknet server on UDP sockets.
+// Listener answers offline handshake packets, tracks a Session for each
+// remote address and passes connected sessions through Accept.
+//
+// A Listener serves one or more shards, each of which is a socket with its
+// own reader goroutine and session table. Sessions stay on the shard which
+// received their handshake. Bans and security cookies are shared by shards,
+// as packets from a remote IP may arrive on any of them.
+type Listener struct {
+	// ID is a server GUID sent with offline packets.
+	ID uint64
+
+	config  Config
+	limiter Limiter
+	shards  []*shard
+	count   int64 // sessions of all shards, accessed atomically
+
+	mu      sync.Mutex // guards bans and cookies
+	bans    *banList
+	cookies cookieJar
+
+	accept    chan *Session
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// shard is a socket of Listener.
+type shard struct {
+	l      *Listener
+	conn   net.PacketConn
+	writer *batchWriter // shared by sessions of the shard
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+
+	// accessed atomically
+	datagramsReceived uint64
+	bytesReceived     uint64
+	offlinePackets    uint64
+}
+
+// ShardStats is statistics of a socket of Listener.
+type ShardStats struct {
+	Addr              net.Addr
+	Sessions          int
+	DatagramsReceived uint64
+	BytesReceived     uint64
+	OfflinePackets    uint64
+}
+
+// Listen announces on the UDP address with default Config.
+func Listen(address string) (*Listener, error) {
+	return new(Config).Listen(address)
+}
+
+// Listen announces on the UDP address and starts serving raknet sessions.
+// If Config.Shards is more than 1, Listen opens the sockets with SO_REUSEPORT.
+func (c *Config) Listen(address string) (*Listener, error) {
+	if n := c.shards(); n > 1 {
+		conns, err := listenReusePort(address, n)
+		if err != nil {
+			return nil, err
+		}
+		return c.Serve(conns[0], conns[1:]...), nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.Serve(conn), nil
+}
+
+// Serve starts serving raknet sessions on conns, each as a shard.
+// The listener owns conns, and closes them when closed.
+func (c *Config) Serve(conn net.PacketConn, conns ...net.PacketConn) *Listener {
+	l := &Listener{
+		ID:      rand.Uint64(),
+		limiter: c.limiter(),
+		bans:    newBanList(c.maxBans()),
+		accept:  make(chan *Session, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	if c != nil {
+		l.config = *c
+	}
+
+	for _, conn := range append([]net.PacketConn{conn}, conns...) {
+		s := &shard{
+			l:        l,
+			conn:     conn,
+			writer:   newBatchWriter(conn),
+			sessions: make(map[string]*Session),
+		}
+		l.shards = append(l.shards, s)
+	}
+	for _, s := range l.shards {
+		go s.serve()
+	}
+	return l
+}
+
+// Accept waits for and returns the next session which finished the connection handshake.
+func (l *Listener) Accept() (*Session, error) {
+	select {
+	case sess := <-l.accept:
+		return sess, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Addr returns the listener's local network address.
+func (l *Listener) Addr() net.Addr {
+	return l.shards[0].conn.LocalAddr()
+}
+
+// ShardStats returns statistics of each shard of the listener.
+func (l *Listener) ShardStats() []ShardStats {
+	stats := make([]ShardStats, len(l.shards))
+	for i, s := range l.shards {
+		s.mu.Lock()
+		stats[i].Sessions = len(s.sessions)
+		s.mu.Unlock()
+		stats[i].Addr = s.conn.LocalAddr()
+		stats[i].DatagramsReceived = atomic.LoadUint64(&s.datagramsReceived)
+		stats[i].BytesReceived = atomic.LoadUint64(&s.bytesReceived)
+		stats[i].OfflinePackets = atomic.LoadUint64(&s.offlinePackets)
+	}
+	return stats
+}
+
+// Close closes all sessions and the listener sockets.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		for _, s := range l.shards {
+			for _, sess := range s.snapshot() {
+				sess.Close()
+			}
+			if e := s.conn.Close(); err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// connected reports whether a connected session with guid exists on any shard.
+func (l *Listener) connected(guid uint64) bool {
+	for _, s := range l.shards {
+		for _, sess := range s.snapshot() {
+			if sess.ID == guid && sess.Connected() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// snapshot returns a list of sessions currently registered.
+func (s *shard) snapshot() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (s *shard) serve() {
+	l := s.l
+	r := newBatchReader(s.conn)
+	interval := l.config.updateInterval()
+	next := time.Now().Add(interval)
+	s.conn.SetReadDeadline(next)
+	for {
+		msgs, err := r.read()
+		if now := time.Now(); !now.Before(next) {
+			s.update(now)
+			next = now.Add(interval)
+			s.conn.SetReadDeadline(next)
+		}
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue
+			}
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithError(err).Warn("Failed to read from listener socket")
+			continue
+		}
+		s.handleBatch(msgs)
+	}
+}
+
+// handleBatch handles datagrams read at once, and writes replies in a batch.
+func (s *shard) handleBatch(msgs []ipv4.Message) {
+	s.writer.hold()
+	defer s.release()
+	for _, m := range msgs {
+		if m.N == 0 {
+			continue
+		}
+		atomic.AddUint64(&s.datagramsReceived, 1)
+		atomic.AddUint64(&s.bytesReceived, uint64(m.N))
+		udp, err := udpAddr(m.Addr)
+		if err != nil {
+			continue
+		}
+
+		if err := s.handle(m.Buffers[0][:m.N], udp); err != nil {
+			log.WithFields(log.Fields{
+				"addr":  m.Addr,
+				"error": err,
+			}).Debug("Failed to handle datagram")
+		}
+	}
+}
+
+// release releases the writer held by the shard.
+func (s *shard) release() {
+	if err := s.writer.release(); err != nil {
+		log.WithError(err).Debug("Failed to write datagrams")
+	}
+}
+
+// udpAddr converts addr read from a PacketConn to UDPAddr.
+func udpAddr(addr net.Addr) (*net.UDPAddr, error) {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+// update calls Update of sessions and expires bans.
+func (s *shard) update(now time.Time) {
+	s.writer.hold()
+	defer s.release()
+	s.l.mu.Lock()
+	s.l.bans.expire(now)
+	s.l.mu.Unlock()
+	for _, sess := range s.snapshot() {
+		if err := sess.Update(now); err != nil {
+			log.WithFields(log.Fields{
+				"addr":  sess.Addr,
+				"error": err,
+			}).Debug("Failed to update session")
+		}
+	}
+}
+
+func (s *shard) session(addr *net.UDPAddr) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[addr.String()]
+}
+
+func (s *shard) handle(b []byte, addr *net.UDPAddr) error {
+	l := s.l
+	sess := s.session(addr)
+	if sess == nil && b[0]&0x80 != 0 {
+		return nil // a late datagram of a closed session
+	}
+	if sess == nil || b[0]&0x80 == 0 {
+		atomic.AddUint64(&s.offlinePackets, 1)
+		return s.handleOffline(b, addr)
+	}
+
+	connected := sess.Status == 3
+	if err := sess.HandlePacket(b); err != nil {
+		return err
+	}
+
+	if !connected && sess.Status == 3 {
+		select {
+		case l.accept <- sess:
+		default:
+			sess.lock()
+			sess.reject(&ConnectionRequestFailed{ServerGUID: l.ID}, ErrConnectionRequestFailed)
+			sess.unlock()
+			return errors.New("raknet: accept backlog is full")
+		}
+	}
+	return nil
+}
+
+// handleOffline answers offline handshake packets within the limit of Config.Limiter.
+// Addresses which sent malformed handshake packets are banned for Config.BanDuration,
+// and get ConnectionBanned until the ban expires. Unknown packets are ignored.
+func (s *shard) handleOffline(b []byte, addr *net.UDPAddr) error {
+	l := s.l
+	now := time.Now()
+	if !l.limiter.Allow(addr.IP, now) {
+		return errors.New("raknet: offline packet rate limit exceeded")
+	}
+	l.mu.Lock()
+	banned := l.bans.banned(addr.IP, now)
+	l.mu.Unlock()
+	if banned {
+		return s.sendOffline(&ConnectionBanned{ServerGUID: l.ID}, addr)
+	}
+
+	reply, err := s.offlineReply(b, addr, now)
+	if err == errInvalidCookie {
+		return err // the source address may be spoofed
+	} else if err != nil {
+		l.mu.Lock()
+		l.bans.ban(addr.IP, now.Add(l.config.banDuration()))
+		l.mu.Unlock()
+		return err
+	} else if reply == nil {
+		return errors.New("raknet: unexpected offline packet ID 0x" + strconv.FormatUint(uint64(b[0]), 16))
+	}
+	return s.sendOffline(reply, addr)
+}
+
+// offlineReply decodes an offline packet and returns the reply,
+// or nil if the packet is not an offline handshake packet.
+func (s *shard) offlineReply(b []byte, addr *net.UDPAddr, now time.Time) (packet.Packet, error) {
+	l := s.l
+	var reply packet.Packet
+	rd := bytes.NewReader(b[1:])
+
+	switch b[0] {
+	case 0x01, 0x02: // UnconnectedPing
+		ping := new(UnconnectedPing)
+		if err := binary.Unmarshal(ping, rd); err != nil {
+			return nil, err
+		}
+		reply = &UnconnectedPong{
+			PingID:     ping.PingID,
+			ServerID:   l.ID,
+			ServerName: binary.FixedMCString(l.serverName()),
+		}
+	case 0x05: // OpenConnectionRequest1
+		req := new(OpenConnectionRequest1)
+		if err := binary.Unmarshal(req, rd); err != nil {
+			return nil, err
+		}
+		if req.ProtoVersion != ProtocolVersion {
+			reply = &IncompatibleProtocolVersion{ProtoVersion: ProtocolVersion, ServerGUID: l.ID}
+			break
+		}
+		reply1 := &OpenConnectionReply1{
+			ServerGUID: l.ID,
+			MTU:        uint16(l.config.clampMTU(int(req.MTU))),
+		}
+		if !l.config.DisableSecurity {
+			reply1.Security = true
+			l.mu.Lock()
+			reply1.Cookie = l.cookies.issue(addr, now)
+			l.mu.Unlock()
+		}
+		reply = reply1
+	case 0x07: // OpenConnectionRequest2
+		req := &OpenConnectionRequest2{Security: !l.config.DisableSecurity}
+		if err := binary.Unmarshal(req, rd); err != nil {
+			return nil, err
+		}
+		if req.Security {
+			l.mu.Lock()
+			ok := l.cookies.verify(addr, req.Cookie, now)
+			l.mu.Unlock()
+			if !ok {
+				return nil, errInvalidCookie
+			}
+		}
+		mtu := l.config.clampMTU(int(req.MTU))
+		if reply = s.newSession(addr, req.ClientGUID, mtu); reply != nil {
+			break
+		}
+		reply = &OpenConnectionReply2{
+			ServerGUID: l.ID,
+			ClientAddr: IPAddr(*addr),
+			MTU:        uint16(mtu),
+		}
+	}
+	return reply, nil
+}
+
+// serverName returns the status from Config.Status if set, or Config.ServerName.
+func (l *Listener) serverName() string {
+	if l.config.Status == nil {
+		return l.config.ServerName
+	}
+	status := l.config.Status()
+	if status.ServerID == 0 {
+		status.ServerID = l.ID
+	}
+	return status.String()
+}
+
+// sendOffline sends an offline packet to addr.
+func (s *shard) sendOffline(pk packet.Packet, addr *net.UDPAddr) error {
+	buf := new(bytes.Buffer)
+	if err := packet.Marshal(pk, buf); err != nil {
+		return err
+	}
+	return s.writer.writeTo(buf.Bytes(), addr)
+}
+
+// newSession registers a session for addr if not exists.
+// If the session cannot be registered, newSession returns a packet to reject
+// the client: AlreadyConnected if the address or GUID is already connected,
+// and NoFreeIncomingConnections if Config.MaxConnections is reached.
+func (s *shard) newSession(addr *net.UDPAddr, guid uint64, mtu int) packet.Packet {
+	l := s.l
+	key := addr.String()
+
+	if sess := s.session(addr); sess != nil {
+		if sess.Connected() || sess.ID != guid {
+			return &AlreadyConnected{ServerGUID: l.ID}
+		}
+		return nil // OpenConnectionReply2 is lost
+	}
+	if l.connected(guid) {
+		return &AlreadyConnected{ServerGUID: l.ID}
+	}
+	count := atomic.AddInt64(&l.count, 1)
+	if max := l.config.MaxConnections; max > 0 && count > int64(max) {
+		atomic.AddInt64(&l.count, -1)
+		return &NoFreeIncomingConnections{ServerGUID: l.ID}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := new(Session).Init(s.conn, addr)
+	sess.writer = s.writer
+	sess.config = &l.config
+	sess.ID = guid
+	sess.serverID = l.ID
+	sess.MTU = mtu
+	sess.Status = 2
+	sess.onClose = func(err error) {
+		s.mu.Lock()
+		if s.sessions[key] == sess {
+			delete(s.sessions, key)
+		}
+		s.mu.Unlock()
+		atomic.AddInt64(&l.count, -1)
+
+		log.WithFields(log.Fields{
+			"addr":   addr,
+			"reason": err,
+		}).Debug("Session closed")
+	}
+	s.sessions[key] = sess
+	return nil
+}
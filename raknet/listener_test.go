@@ -0,0 +1,303 @@
+package raknet
+
+import (
+	"bytes"
+	"github.com/cr0sh/encore/util/binary"
+	"github.com/cr0sh/encore/util/packet"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestListenerPing(t *testing.T) {
+	l, err := (&Config{ServerName: "MCPE;encore"}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := new(bytes.Buffer)
+	if err := packet.Marshal(&UnconnectedPing{PingID: 1234}, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != (*UnconnectedPong)(nil).ID() {
+		t.Fatalf("Expected UnconnectedPong, got ID 0x%x", b[0])
+	}
+
+	pong := new(UnconnectedPong)
+	if err := binary.Unmarshal(pong, bytes.NewReader(b[1:n])); err != nil {
+		t.Fatal(err)
+	}
+	if pong.PingID != 1234 || pong.ServerID != l.ID || pong.ServerName != "MCPE;encore" {
+		t.Errorf("Unexpected UnconnectedPong %+v", pong)
+	}
+}
+
+func TestDialListener(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *Session, 1)
+	go func() {
+		sess, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- sess
+	}()
+
+	client, err := (&Config{HandshakeTimeout: 3 * time.Second}).Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if !client.Connected() {
+		t.Fatal("Expected client connected")
+	}
+
+	var server *Session
+	select {
+	case server = <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Accept timed out")
+	}
+	if server.ID != client.ID {
+		t.Errorf("Expected server-side ID %d, got %d", client.ID, server.ID)
+	}
+
+	option := &StreamOption{MessageIndex: true, OrderChannel: -1}
+	if err := client.SendEncapsulatedStream(bytes.NewReader([]byte("\xfeping")), option); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := server.ReadPacket(); err != nil || string(b) != "\xfeping" {
+		t.Fatalf("Expected \\xfeping, got %q(error %v)", b, err)
+	}
+
+	if err := server.SendEncapsulatedStream(bytes.NewReader([]byte("\xfepong")), option); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := client.ReadPacket(); err != nil || string(b) != "\xfepong" {
+		t.Fatalf("Expected \\xfepong, got %q(error %v)", b, err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	config := &Config{Timeout: 300 * time.Millisecond, PingInterval: 50 * time.Millisecond}
+	l, err := config.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := config.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * config.Timeout)
+	if err := server.Err(); err != nil {
+		t.Fatalf("Expected idle session kept alive, got %v", err)
+	}
+	if err := client.Err(); err != nil {
+		t.Fatalf("Expected idle client kept alive, got %v", err)
+	}
+
+	client.ServerConn.Close()
+	select {
+	case <-server.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected silent session timed out")
+	}
+	if _, err := server.ReadPacket(); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestDialListenerIPv6(t *testing.T) {
+	l, err := Listen("[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	defer l.Close()
+
+	client, err := (&Config{HandshakeTimeout: 3 * time.Second}).Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.SendEncapsulatedStream(bytes.NewReader([]byte("\xfeping")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := server.ReadPacket(); err != nil || string(b) != "\xfeping" {
+		t.Fatalf("Expected \\xfeping, got %q(error %v)", b, err)
+	}
+}
+
+func TestRejectConnection(t *testing.T) {
+	config := &Config{MaxConnections: 1, DisableSecurity: true, HandshakeTimeout: 3 * time.Second}
+	l, err := config.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := config.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := config.Dial(l.Addr().String()); err != ErrNoFreeConnections {
+		t.Errorf("Expected ErrNoFreeConnections, got %v", err)
+	}
+
+	cases := []struct {
+		pk     packet.Packet
+		expect byte
+	}{
+		{&OpenConnectionRequest1{ProtoVersion: ProtocolVersion - 1, MTU: MinMTU}, 0x19},
+		{&OpenConnectionRequest2{
+			RemoteAddr: IPAddr(*l.Addr().(*net.UDPAddr)),
+			MTU:        MinMTU,
+			ClientGUID: client.ID,
+		}, 0x12},
+	}
+	for i, c := range cases {
+		conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := packet.Marshal(c.pk, buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, maxDatagramSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := conn.Read(b); err != nil || n == 0 || b[0] != c.expect {
+			t.Errorf("Test #%d: expected ID 0x%x, got %x(error %v)", i, c.expect, b[:n], err)
+		}
+		conn.Close()
+	}
+}
+
+func TestListenerShards(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Listener shards are supported only on Linux")
+	}
+	const shards, clients = 4, 16
+	config := &Config{Shards: shards, HandshakeTimeout: 3 * time.Second}
+	l, err := config.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < clients; i++ {
+		client, err := config.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SendEncapsulatedStream(bytes.NewReader([]byte("\xfeping")), nil); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := server.ReadPacket(); err != nil || string(b) != "\xfeping" {
+			t.Fatalf("Expected \\xfeping, got %q(error %v)", b, err)
+		}
+	}
+
+	stats := l.ShardStats()
+	if len(stats) != shards {
+		t.Fatalf("Expected %d shards, got %d", shards, len(stats))
+	}
+	sessions := 0
+	for i, s := range stats {
+		if s.Addr.String() != l.Addr().String() {
+			t.Errorf("Shard #%d: expected address %v, got %v", i, l.Addr(), s.Addr)
+		}
+		if s.Sessions > 0 && s.DatagramsReceived == 0 {
+			t.Errorf("Shard #%d: expected datagrams received, got %+v", i, s)
+		}
+		sessions += s.Sessions
+	}
+	if sessions != clients {
+		t.Errorf("Expected %d sessions, got %d", clients, sessions)
+	}
+}
+
+func TestRecvQueueFull(t *testing.T) {
+	config := &Config{HandshakeTimeout: 3 * time.Second}
+	l, err := config.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := config.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	option := &StreamOption{MessageIndex: true, OrderChannel: 0}
+	for i := 0; i < RecvQueueSize+100; i++ {
+		if err := client.SendEncapsulatedStream(bytes.NewReader([]byte("\xfedata")), option); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-server.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the session not read closed")
+	}
+	if err := server.Err(); err != ErrRecvQueueFull {
+		t.Errorf("Expected ErrRecvQueueFull, got %v", err)
+	}
+
+	other, err := config.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected the listener serving others, got %v", err)
+	}
+	other.Close()
+}
@@ -0,0 +1,91 @@
+package raknet
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cr0sh/encore/util/binary"
+	"io"
+	"syscall"
+)
+
+// mtuSizes are MTU sizes probed by the client in descending order.
+var mtuSizes = []int{1492, 1200, 576}
+
+// mtuAttempts is a number of OpenConnectionRequest1 sent for each MTU size
+// before falling back to the next one.
+const mtuAttempts = 2
+
+// request1HeaderLen is the size of OpenConnectionRequest1 without padding.
+const request1HeaderLen = 1 + len(OFFLINE_MESSAGE_DATA_ID) + 1
+
+// MarshalStream implements Stream Marshaler interface.
+// The packet is padded with zeros to fill the MTU size.
+func (pk OpenConnectionRequest1) MarshalStream(wr io.Writer) error {
+	b := make([]byte, len(OFFLINE_MESSAGE_DATA_ID)+1)
+	copy(b, OFFLINE_MESSAGE_DATA_ID)
+	b[len(b)-1] = pk.ProtoVersion
+	if pad := int(pk.MTU) - ipUDPHeaderLen - request1HeaderLen; pad > 0 {
+		b = append(b, make([]byte, pad)...)
+	}
+	_, err := wr.Write(b)
+	return err
+}
+
+// UnmarshalStream implements Stream Unmarshaler interface.
+// MTU is computed from the size of the padding.
+func (pk *OpenConnectionRequest1) UnmarshalStream(rd io.Reader) error {
+	if err := pk.OfflineMsg.UnmarshalStream(rd); err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return err
+	}
+	pk.ProtoVersion = b[0]
+
+	pad, err := io.Copy(io.Discard, rd)
+	if err != nil {
+		return err
+	}
+	pk.MTU = uint16(int(pad) + request1HeaderLen + ipUDPHeaderLen)
+	return nil
+}
+
+// discoverMTU sends OpenConnectionRequest1 padded to descending MTU sizes,
+// and returns the largest size replied with OpenConnectionReply1.
+// The last size is retried until the handshake deadline.
+func (d *dialer) discoverMTU() (int, *OpenConnectionReply1, error) {
+	sizes := []int{d.config.mtu()}
+	for _, size := range mtuSizes {
+		if size < sizes[0] {
+			sizes = append(sizes, size)
+		}
+	}
+
+	setDontFragment(d.conn, true)
+	defer setDontFragment(d.conn, false)
+
+	for i, size := range sizes {
+		attempts := mtuAttempts
+		if i == len(sizes)-1 {
+			attempts = 0
+		}
+
+		b, err := d.request(&OpenConnectionRequest1{
+			ProtoVersion: ProtocolVersion,
+			MTU:          uint16(size),
+		}, 0x06, attempts)
+		if err == ErrHandshakeTimeout || errors.Is(err, syscall.EMSGSIZE) {
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		reply := new(OpenConnectionReply1)
+		if err := binary.Unmarshal(reply, bytes.NewReader(b)); err != nil {
+			return 0, nil, err
+		}
+		return size, reply, nil
+	}
+	return 0, nil, ErrHandshakeTimeout
+}
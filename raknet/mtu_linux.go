@@ -0,0 +1,28 @@
+package raknet
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets DF bit on datagrams sent from conn during MTU discovery,
+// so that oversized probes are dropped instead of being fragmented.
+// It is best-effort, and errors are ignored.
+func setDontFragment(conn net.PacketConn, on bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	v4, v6 := syscall.IP_PMTUDISC_WANT, syscall.IPV6_PMTUDISC_WANT
+	if on {
+		v4, v6 = syscall.IP_PMTUDISC_DO, syscall.IPV6_PMTUDISC_DO
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v6)
+	})
+}
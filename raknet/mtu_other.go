@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package raknet
+
+import (
+	"net"
+)
+
+// setDontFragment is not supported on this platform. MTU discovery relies on
+// the network dropping fragmented probes.
+func setDontFragment(conn net.PacketConn, on bool) {}
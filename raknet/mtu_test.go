@@ -0,0 +1,137 @@
+package raknet
+
+import (
+	"bytes"
+	"github.com/cr0sh/encore/util/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOpenConnectionRequest1MTU(t *testing.T) {
+	cases := []uint16{1492, 1200, 576}
+	for i, mtu := range cases {
+		buf := new(bytes.Buffer)
+		if err := packet.Marshal(&OpenConnectionRequest1{ProtoVersion: ProtocolVersion, MTU: mtu}, buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len()+ipUDPHeaderLen != int(mtu) {
+			t.Errorf("Test #%d: expected %d bytes padded, got %d", i, int(mtu)-ipUDPHeaderLen, buf.Len())
+		}
+
+		req := new(OpenConnectionRequest1)
+		if err := req.UnmarshalStream(bytes.NewReader(buf.Bytes()[1:])); err != nil {
+			t.Fatal(err)
+		}
+		if req.MTU != mtu || req.ProtoVersion != ProtocolVersion {
+			t.Errorf("Test #%d: expected MTU %d, got %+v", i, mtu, req)
+		}
+	}
+}
+
+// relayUDP forwards datagrams between a client and target,
+// dropping ones larger than limit bytes.
+func relayUDP(t *testing.T, target *net.UDPAddr, limit int) *net.UDPConn {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := make(chan *net.UDPAddr, 1)
+	go func() {
+		defer back.Close()
+		buf := make([]byte, maxDatagramSize)
+		var addr *net.UDPAddr
+		for {
+			n, from, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if addr == nil {
+				addr = from
+				client <- from
+			}
+			if n <= limit {
+				back.WriteToUDP(buf[:n], target)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		addr := <-client
+		for {
+			n, _, err := back.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n <= limit {
+				front.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+	return front
+}
+
+func TestConfigMTU(t *testing.T) {
+	cases := []struct {
+		config *Config
+		expect int
+	}{
+		{nil, DefaultMTU},
+		{&Config{MTU: 100}, MinMTU},
+		{&Config{MTU: 1400}, 1400},
+		{&Config{MTU: 9000}, MaxMTU},
+	}
+	for i, c := range cases {
+		if mtu := c.config.mtu(); mtu != c.expect {
+			t.Errorf("Test #%d: expected MTU %d, got %d", i, c.expect, mtu)
+		}
+	}
+}
+
+func TestMTUDiscovery(t *testing.T) {
+	cases := []struct {
+		serverMTU, limit int
+		expect           int
+	}{
+		{0, maxDatagramSize, DefaultMTU},
+		{1400, maxDatagramSize, 1400},
+		{0, 1000, 576},
+	}
+
+	for i, c := range cases {
+		l, err := (&Config{MTU: c.serverMTU}).Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay := relayUDP(t, l.Addr().(*net.UDPAddr), c.limit)
+
+		client, err := (&Config{HandshakeTimeout: 5 * time.Second}).Dial(relay.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Test #%d: %v", i, err)
+		}
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.MTU != c.expect || server.MTU != c.expect {
+			t.Errorf("Test #%d: expected MTU %d, got client %d, server %d", i, c.expect, client.MTU, server.MTU)
+		}
+
+		payload := bytes.Repeat([]byte{0xfe}, 3000)
+		if err := client.SendEncapsulatedStream(bytes.NewReader(payload), nil); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := server.ReadPacket(); err != nil || !bytes.Equal(b, payload) {
+			t.Errorf("Test #%d: expected split payload delivered, got %d bytes(error %v)", i, len(b), err)
+		}
+
+		client.Close()
+		relay.Close()
+		l.Close()
+	}
+}
@@ -0,0 +1,122 @@
+package raknet
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipeQueueSize is a number of datagrams buffered for each end of PacketPipe.
+// Datagrams over the buffer are dropped like UDP.
+const pipeQueueSize = 1024
+
+// pipePort is the last port number assigned to an end of PacketPipe.
+var pipePort uint32
+
+// PacketPipe creates an in-memory datagram transport between two ends,
+// like net.Pipe. Each end has a distinct loopback UDPAddr, and datagrams
+// written to the address of the other end are delivered to it.
+// It is useful to run Listener and Dial without sockets in tests.
+func PacketPipe() (net.PacketConn, net.PacketConn) {
+	a, b := newPipeConn(), newPipeConn()
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+type pipeConn struct {
+	addr *net.UDPAddr
+	peer *pipeConn
+
+	recv      chan *[]byte // pooled copies of datagrams
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	readDeadline deadline
+}
+
+func newPipeConn() *pipeConn {
+	port := atomic.AddUint32(&pipePort, 1)%0xffff + 1
+	c := &pipeConn{
+		addr:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)},
+		recv:   make(chan *[]byte, pipeQueueSize),
+		closed: make(chan struct{}),
+	}
+	c.readDeadline.init()
+	return c
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *pipeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	default:
+	}
+
+	select {
+	case p := <-c.recv:
+		n := copy(b, *p)
+		putBuffer(p)
+		return n, c.peer.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo implements net.PacketConn. Datagrams to other addresses than
+// the other end are silently dropped.
+func (c *pipeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if isClosedChan(c.closed) {
+		return 0, net.ErrClosed
+	}
+	if !sameAddr(addr, c.peer.addr) || isClosedChan(c.peer.closed) {
+		return len(b), nil
+	}
+
+	p := getBuffer()
+	*p = append(*p, b...)
+	select {
+	case c.peer.recv <- p:
+	default:
+		putBuffer(p)
+	}
+	return len(b), nil
+}
+
+// Close implements net.PacketConn.
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements net.PacketConn. Writes never block.
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn. Writes never block.
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
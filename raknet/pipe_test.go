@@ -0,0 +1,107 @@
+package raknet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketPipe(t *testing.T) {
+	serverConn, clientConn := PacketPipe()
+	l := new(Config).Serve(serverConn)
+	defer l.Close()
+
+	client, err := (&Config{HandshakeTimeout: 3 * time.Second}).DialConn(clientConn, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameAddr(server.Addr, clientConn.LocalAddr().(*net.UDPAddr)) {
+		t.Errorf("Expected remote address %v, got %v", clientConn.LocalAddr(), server.Addr)
+	}
+
+	payload := bytes.Repeat([]byte{0xfe}, 5000)
+	if err := client.SendEncapsulatedStream(bytes.NewReader(payload), nil); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := server.ReadPacket(); err != nil || !bytes.Equal(b, payload) {
+		t.Fatalf("Expected payload delivered, got %d bytes(error %v)", len(b), err)
+	}
+
+	client.Close()
+	if _, err := server.ReadPacket(); err != ErrDisconnected {
+		t.Errorf("Expected ErrDisconnected, got %v", err)
+	}
+	if _, _, err := clientConn.ReadFrom(make([]byte, 1)); err != net.ErrClosed {
+		t.Errorf("Expected closed client conn, got %v", err)
+	}
+}
+
+func TestConcurrentSession(t *testing.T) {
+	serverConn, clientConn := PacketPipe()
+	l := new(Config).Serve(serverConn)
+	defer l.Close()
+
+	client, err := (&Config{HandshakeTimeout: 3 * time.Second}).DialConn(clientConn, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const senders, messages = 4, 100
+	receipts := make(chan Receipt, senders*messages)
+	client.lock()
+	client.ReceiptHandler = func(r Receipt) {
+		client.Stats() // callbacks must not deadlock on the session mutex
+		receipts <- r
+	}
+	client.unlock()
+
+	option := &StreamOption{MessageIndex: true, OrderChannel: 0}
+	for i := 0; i < senders; i++ {
+		go func() {
+			for j := 0; j < messages; j++ {
+				if _, err := client.SendWithReceipt(bytes.NewReader([]byte("\xfedata")), option); err != nil {
+					t.Error(err)
+					return
+				}
+				client.Stats()
+			}
+		}()
+	}
+	go func() {
+		for j := 0; j < messages; j++ {
+			server.SendEncapsulatedStream(bytes.NewReader([]byte("\xfeecho")), option)
+		}
+	}()
+
+	for i := 0; i < senders*messages; i++ {
+		if b, err := server.ReadPacket(); err != nil || string(b) != "\xfedata" {
+			t.Fatalf("Expected \\xfedata, got %q(error %v)", b, err)
+		}
+	}
+	for i := 0; i < messages; i++ {
+		if b, err := client.ReadPacket(); err != nil || string(b) != "\xfeecho" {
+			t.Fatalf("Expected \\xfeecho, got %q(error %v)", b, err)
+		}
+	}
+	for i := 0; i < senders*messages; i++ {
+		select {
+		case r := <-receipts:
+			if !r.Acked {
+				t.Errorf("Expected receipt %d acked", r.ID)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Expected %d receipts, got %d", senders*messages, i)
+		}
+	}
+}
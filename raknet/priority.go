@@ -0,0 +1,100 @@
+package raknet
+
+// Priority is a send priority of EncapsulatedPackets.
+type Priority int
+
+const (
+	// PriorityMedium is the default priority.
+	PriorityMedium Priority = iota
+
+	// PriorityHigh is for latency-sensitive packets, e.g. keepalives and input acknowledgements.
+	PriorityHigh
+
+	// PriorityLow is for bulk data, e.g. world chunks.
+	PriorityLow
+
+	// PriorityImmediate packets bypass the send queue and the congestion window,
+	// unless StreamOption.Queue is set. Queued immediate packets are treated as PriorityHigh.
+	PriorityImmediate
+)
+
+// priorityWeights is a number of EncapsulatedPackets each send queue can send
+// in a round of weighted round-robin scheduling, indexed by queueIndex.
+// Each priority is sent twice as often as the next lower one.
+var priorityWeights = [3]int{4, 2, 1}
+
+// queueIndex returns the index of the send queue for the priority.
+func (p Priority) queueIndex() int {
+	switch p {
+	case PriorityHigh, PriorityImmediate:
+		return 0
+	case PriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// sendQueue is a FIFO queue of EncapsulatedPackets, which reuses its buffer
+// instead of allocating a new one each time it is drained.
+type sendQueue struct {
+	eps  []EncapsulatedPacket
+	head int // index of the first packet in eps
+}
+
+// len returns the number of packets in the queue.
+func (q *sendQueue) len() int {
+	return len(q.eps) - q.head
+}
+
+// push puts eps after the queue.
+func (q *sendQueue) push(eps []EncapsulatedPacket) {
+	if q.head > 0 && len(q.eps)+len(eps) > cap(q.eps) {
+		n := copy(q.eps, q.eps[q.head:])
+		q.eps = q.eps[:n]
+		q.head = 0
+	}
+	q.eps = append(q.eps, eps...)
+}
+
+// peek returns the first packet. The queue must not be empty.
+func (q *sendQueue) peek() EncapsulatedPacket {
+	return q.eps[q.head]
+}
+
+// pop removes the first packet. The queue must not be empty.
+func (q *sendQueue) pop() {
+	q.eps[q.head] = EncapsulatedPacket{} // drop the reference to the payload
+	q.head++
+	if q.head == len(q.eps) {
+		q.eps, q.head = q.eps[:0], 0
+	}
+}
+
+// enqueue puts eps after the send queue of the priority.
+func (sess *Session) enqueue(p Priority, eps []EncapsulatedPacket) {
+	sess.sendQueues[p.queueIndex()].push(eps)
+}
+
+// queued returns the number of EncapsulatedPackets in the send queues.
+func (sess *Session) queued() int {
+	n := 0
+	for i := range sess.sendQueues {
+		n += sess.sendQueues[i].len()
+	}
+	return n
+}
+
+// nextQueue returns the index of the send queue to take the next EncapsulatedPacket
+// from, by weighted round-robin. It returns -1 if all send queues are empty.
+func (sess *Session) nextQueue() int {
+	for round := 0; round < 2; round++ {
+		for i := range sess.sendQueues {
+			if sess.sendQueues[i].len() > 0 && sess.credits[i] > 0 {
+				return i
+			}
+		}
+		sess.credits = priorityWeights
+	}
+	return -1
+}
@@ -0,0 +1,60 @@
+package raknet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// fixedWindow is a CongestionController with a constant window.
+type fixedWindow int
+
+func (w fixedWindow) Window() int                     { return int(w) }
+func (fixedWindow) OnSend(seq uint32, size int)       {}
+func (fixedWindow) OnACK(size int, rtt time.Duration) {}
+func (fixedWindow) OnLoss(seq uint32, timeout bool)   {}
+
+func TestSendPriority(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sess := new(Session).Init(conn, conn.LocalAddr().(*net.UDPAddr))
+	sess.MTU = DefaultMTU
+	sess.Congestion = fixedWindow(1 << 20)
+
+	for _, p := range []struct {
+		payload  string
+		priority Priority
+	}{{"l", PriorityLow}, {"m", PriorityMedium}, {"h", PriorityHigh}} {
+		option := &StreamOption{Queue: true, OrderChannel: -1, Priority: p.priority}
+		for i := 0; i < 8; i++ {
+			if err := sess.SendEncapsulatedStream(bytes.NewReader([]byte(p.payload)), option); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sess.Congestion = fixedWindow(1)
+	if err := sess.SendEncapsulatedStream(bytes.NewReader([]byte("i")),
+		&StreamOption{OrderChannel: -1, Priority: PriorityImmediate}); err != nil {
+		t.Fatal(err)
+	}
+	sess.Congestion = fixedWindow(1 << 20)
+	if err := sess.FlushSendQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := ""
+	for seq := uint32(0); seq < sess.sendSeq; seq++ {
+		for _, ep := range sess.recoveryPool[seq].packets {
+			sent += string(ep.Payload)
+		}
+	}
+	if expect := "i" + "hhhhmml" + "hhhhmml" + "mml" + "mml" + "llll"; sent != expect {
+		t.Errorf("Expected send order %s, got %s", expect, sent)
+	}
+}
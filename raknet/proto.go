@@ -49,6 +49,10 @@ func (*UnconnectedPong) ID() byte {
 type OpenConnectionRequest1 struct {
 	OfflineMsg   offlineMessageDataID
 	ProtoVersion byte
+
+	// MTU is not a field on the wire, but the size of the packet
+	// padded with zeros, including IP/UDP headers.
+	MTU uint16
 }
 
 func (*OpenConnectionRequest1) ID() byte {
@@ -60,6 +64,7 @@ type OpenConnectionReply1 struct {
 	OfflineMsg offlineMessageDataID
 	ServerGUID uint64
 	Security   bool
+	Cookie     uint32 // only on the wire if Security is set
 	MTU        uint16
 }
 
@@ -70,6 +75,12 @@ func (*OpenConnectionReply1) ID() byte {
 // Packet ID: 0x07
 type OpenConnectionRequest2 struct {
 	OfflineMsg offlineMessageDataID
+
+	// Security is not a field on the wire. It must be set before
+	// unmarshaling, since Cookie is only on the wire if the server
+	// replied OpenConnectionReply1 with Security.
+	Security   bool
+	Cookie     uint32
 	RemoteAddr IPAddr
 	MTU        uint16
 	ClientGUID uint64
@@ -116,6 +127,29 @@ func (*ServerHandshake) ID() byte {
 	return 0x10
 }
 
+// ConnectionRequestAccepted is the RakNet name of ServerHandshake.
+type ConnectionRequestAccepted = ServerHandshake
+
+// Packet ID: 0x11
+type ConnectionRequestFailed struct {
+	OfflineMsg offlineMessageDataID
+	ServerGUID uint64
+}
+
+func (*ConnectionRequestFailed) ID() byte {
+	return 0x11
+}
+
+// Packet ID: 0x12
+type AlreadyConnected struct {
+	OfflineMsg offlineMessageDataID
+	ServerGUID uint64
+}
+
+func (*AlreadyConnected) ID() byte {
+	return 0x12
+}
+
 // Packet ID: 0x13
 type ClientHandshake struct {
 	ClientAddr   IPAddr
@@ -128,9 +162,43 @@ func (*ClientHandshake) ID() byte {
 	return 0x13
 }
 
+// Packet ID: 0x14
+type NoFreeIncomingConnections struct {
+	OfflineMsg offlineMessageDataID
+	ServerGUID uint64
+}
+
+func (*NoFreeIncomingConnections) ID() byte {
+	return 0x14
+}
+
 // Packet ID: 0x15
 type ClientDisconnect struct{}
 
 func (*ClientDisconnect) ID() byte {
 	return 0x15
 }
+
+// DisconnectionNotification is the RakNet name of ClientDisconnect.
+type DisconnectionNotification = ClientDisconnect
+
+// Packet ID: 0x17
+type ConnectionBanned struct {
+	OfflineMsg offlineMessageDataID
+	ServerGUID uint64
+}
+
+func (*ConnectionBanned) ID() byte {
+	return 0x17
+}
+
+// Packet ID: 0x19
+type IncompatibleProtocolVersion struct {
+	ProtoVersion byte
+	OfflineMsg   offlineMessageDataID
+	ServerGUID   uint64
+}
+
+func (*IncompatibleProtocolVersion) ID() byte {
+	return 0x19
+}
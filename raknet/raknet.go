@@ -24,60 +24,141 @@ func (offlineMessageDataID) MarshalStream(wr io.Writer) (err error) {
 	return
 }
 
+// errOfflineMessageDataID is returned when an offline packet has wrong magic bytes.
+var errOfflineMessageDataID = errors.New("invalid offline message data ID")
+
 func (*offlineMessageDataID) UnmarshalStream(rd io.Reader) (err error) {
-	_, err = rd.Read(make([]byte, len([]byte(OFFLINE_MESSAGE_DATA_ID))))
+	b := make([]byte, len(OFFLINE_MESSAGE_DATA_ID))
+	if _, err = io.ReadFull(rd, b); err != nil {
+		return
+	}
+	if string(b) != OFFLINE_MESSAGE_DATA_ID {
+		return errOfflineMessageDataID
+	}
 	return
 }
 
 // IPAddr represents a single UDP endpoint address in raknet.
+//
+// IPv4 addresses are encoded as version 4, bitwise-NOT octets and port.
+// IPv6 addresses are encoded as version 6 and sockaddr_in6 layout:
+// family, port, flowinfo, address and scope id.
 type IPAddr net.UDPAddr
 
+const (
+	ipv4AddrLen = 7
+	ipv6AddrLen = 29
+
+	// afInet6 is AF_INET6 of Windows, which is written by RakNet.
+	afInet6 = 23
+)
+
 // MarshalStream implements Stream Marshaler interface.
 func (a IPAddr) MarshalStream(wr io.Writer) error {
-	v4ip := a.IP.To4() // Currently only supports IPv4
-	b := make([]byte, 7)
-	b[0] = 4
-	copy(b[1:5], v4ip[:4])
-	binary.BigEndian.PutUint16(b[5:7], uint16(a.Port))
+	if v4ip := a.IP.To4(); v4ip != nil || a.IP == nil {
+		if v4ip == nil {
+			v4ip = net.IPv4zero.To4()
+		}
+		b := make([]byte, ipv4AddrLen)
+		b[0] = 4
+		for i := 0; i < 4; i++ {
+			b[1+i] = ^v4ip[i]
+		}
+		binary.BigEndian.PutUint16(b[5:7], uint16(a.Port))
+		_, err := wr.Write(b)
+		return err
+	}
+
+	v6ip := a.IP.To16()
+	if v6ip == nil {
+		return errors.New("invalid IP address " + a.IP.String())
+	}
+	b := make([]byte, ipv6AddrLen)
+	b[0] = 6
+	binary.LittleEndian.PutUint16(b[1:3], afInet6)
+	binary.BigEndian.PutUint16(b[3:5], uint16(a.Port))
+	copy(b[9:25], v6ip)
+	binary.BigEndian.PutUint32(b[25:29], zoneIndex(a.Zone))
 	_, err := wr.Write(b)
 	return err
 }
 
 // UnmarshalStream implements Strream Unmarshaler interface.
 func (a *IPAddr) UnmarshalStream(rd io.Reader) (err error) {
-	b := make([]byte, 7)
-	if _, err = rd.Read(b); err != nil {
+	b := make([]byte, ipv6AddrLen)
+	if _, err = io.ReadFull(rd, b[:1]); err != nil {
 		return
 	}
-	if b[0] != 4 {
-		return errors.New("IPAddr only supports IPv4, v" + strconv.Itoa(int(b[0])) + " given")
+
+	switch b[0] {
+	case 4:
+		if _, err = io.ReadFull(rd, b[1:ipv4AddrLen]); err != nil {
+			return
+		}
+		a.IP = net.IPv4(^b[1], ^b[2], ^b[3], ^b[4])
+		a.Port = int(binary.BigEndian.Uint16(b[5:7]))
+		a.Zone = ""
+	case 6:
+		if _, err = io.ReadFull(rd, b[1:ipv6AddrLen]); err != nil {
+			return
+		}
+		a.IP = make(net.IP, net.IPv6len)
+		copy(a.IP, b[9:25])
+		a.Port = int(binary.BigEndian.Uint16(b[3:5]))
+		a.Zone = zoneName(binary.BigEndian.Uint32(b[25:29]))
+	default:
+		return errors.New("IPAddr only supports IPv4 and IPv6, v" + strconv.Itoa(int(b[0])) + " given")
 	}
+	return nil
+}
 
-	a.IP = net.IPv4(^b[1], ^b[2], ^b[3], ^b[4])
-	a.Port = int(binary.BigEndian.Uint16(b[5:7]))
+// zoneIndex returns the scope id of IPv6 zone.
+func zoneIndex(zone string) uint32 {
+	if zone == "" {
+		return 0
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return uint32(ifi.Index)
+	}
+	n, _ := strconv.ParseUint(zone, 10, 32)
+	return uint32(n)
+}
 
-	return nil
+// zoneName returns IPv6 zone of the scope id.
+func zoneName(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+	if ifi, err := net.InterfaceByIndex(int(index)); err == nil {
+		return ifi.Name
+	}
+	return strconv.FormatUint(uint64(index), 10)
 }
 
-const systemAddressesReady = "\x04\x80\xff\xff\xfe\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00" +
-	"\x04\xff\xff\xff\xff\x00\x00"
-
-type systemAddresses struct{}
-
-func (systemAddresses) MarshalStream(wr io.Writer) (err error) {
-	_, err = wr.Write([]byte(systemAddressesReady))
-	return
+// systemAddressCount is a number of system addresses in connection handshake packets.
+const systemAddressCount = 10
+
+// systemAddresses is a list of internal addresses sent in connection handshake.
+// Empty entries are encoded as 0.0.0.0:0.
+type systemAddresses [systemAddressCount]IPAddr
+
+// localSystemAddresses is systemAddresses sent by Session.
+var localSystemAddresses = systemAddresses{{IP: net.IPv4(127, 0, 0, 1)}}
+
+func (addrs systemAddresses) MarshalStream(wr io.Writer) error {
+	for _, addr := range addrs {
+		if err := addr.MarshalStream(wr); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (*systemAddresses) UnmarshalStream(rd io.Reader) (err error) {
-	_, err = rd.Read(make([]byte, len([]byte(systemAddressesReady))))
-	return
+func (addrs *systemAddresses) UnmarshalStream(rd io.Reader) error {
+	for i := range addrs {
+		if err := addrs[i].UnmarshalStream(rd); err != nil {
+			return err
+		}
+	}
+	return nil
 }
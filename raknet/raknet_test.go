@@ -0,0 +1,67 @@
+package raknet
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIPAddr(t *testing.T) {
+	cases := []struct {
+		addr   IPAddr
+		expect string
+	}{
+		{IPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 19132}, "\x04\x80\xff\xff\xfe\x4a\xbc"},
+		{IPAddr{IP: net.IPv4zero}, "\x04\xff\xff\xff\xff\x00\x00"},
+		{IPAddr{IP: net.IPv6loopback, Port: 19133},
+			"\x06\x17\x00\x4a\xbd\x00\x00\x00\x00" + strings.Repeat("\x00", 15) + "\x01\x00\x00\x00\x00"},
+		{IPAddr{IP: net.ParseIP("fe80::1"), Port: 1, Zone: "7"},
+			"\x06\x17\x00\x00\x01\x00\x00\x00\x00\xfe\x80" + strings.Repeat("\x00", 13) + "\x01\x00\x00\x00\x07"},
+	}
+
+	for i, c := range cases {
+		buf := new(bytes.Buffer)
+		if err := c.addr.MarshalStream(buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.expect {
+			t.Errorf("Test #%d: expected %q, got %q", i, c.expect, buf.String())
+		}
+
+		addr := new(IPAddr)
+		if err := addr.UnmarshalStream(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !addr.IP.Equal(c.addr.IP) || addr.Port != c.addr.Port {
+			t.Errorf("Test #%d: expected %v, got %v", i, (*net.UDPAddr)(&c.addr), (*net.UDPAddr)(addr))
+		}
+	}
+}
+
+func TestSystemAddresses(t *testing.T) {
+	addrs := localSystemAddresses
+	addrs[1] = IPAddr{IP: net.IPv6loopback, Port: 19132}
+
+	buf := new(bytes.Buffer)
+	if err := addrs.MarshalStream(buf); err != nil {
+		t.Fatal(err)
+	}
+	if expect := 9*ipv4AddrLen + ipv6AddrLen; buf.Len() != expect {
+		t.Fatalf("Expected %d bytes, got %d", expect, buf.Len())
+	}
+
+	decoded := new(systemAddresses)
+	if err := decoded.UnmarshalStream(buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := range addrs {
+		ip := addrs[i].IP
+		if ip == nil {
+			ip = net.IPv4zero
+		}
+		if !decoded[i].IP.Equal(ip) || decoded[i].Port != addrs[i].Port {
+			t.Errorf("Test #%d: expected %v, got %v", i, (*net.UDPAddr)(&addrs[i]), (*net.UDPAddr)(&decoded[i]))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package raknet
+
+import (
+	"io"
+	"sort"
+)
+
+// Receipt is a delivery report of a message sent with Session.SendWithReceipt.
+type Receipt struct {
+	ID uint32
+
+	// Acked is true if every DataPacket carrying the message is acknowledged,
+	// and false if the message is lost: an unreliable part of it was not
+	// acknowledged, or the session is closed before acknowledgement.
+	Acked bool
+}
+
+// SendWithReceipt sends given stream like SendEncapsulatedStream, and returns
+// a receipt ID. Delivery of the stream is reported to ReceiptHandler with the ID.
+//
+// The message is sent with plain reliabilities on the wire; 'with ack receipt'
+// reliabilities(5, 6, 7) are only tracked locally like RakNet does.
+func (sess *Session) SendWithReceipt(rd io.Reader, option *StreamOption) (uint32, error) {
+	sess.lock()
+	defer sess.unlock()
+	sess.sendReceiptID++
+	id := sess.sendReceiptID
+	return id, sess.sendStream(rd, option, id)
+}
+
+// receiptAcked counts down the pending parts of a receipt.
+func (sess *Session) receiptAcked(id uint32) {
+	pending, ok := sess.receipts[id]
+	if !ok {
+		return
+	}
+	if pending > 1 {
+		sess.receipts[id] = pending - 1
+		return
+	}
+	delete(sess.receipts, id)
+	sess.report(Receipt{ID: id, Acked: true})
+}
+
+// receiptLost reports the receipt as lost, ignoring later acknowledgements.
+func (sess *Session) receiptLost(id uint32) {
+	if _, ok := sess.receipts[id]; !ok {
+		return
+	}
+	delete(sess.receipts, id)
+	sess.report(Receipt{ID: id})
+}
+
+// dropReceipts reports all pending receipts as lost, in order of their IDs.
+func (sess *Session) dropReceipts() {
+	ids := make([]int, 0, len(sess.receipts))
+	for id := range sess.receipts {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		sess.receiptLost(uint32(id))
+	}
+}
+
+// report passes r to ReceiptHandler after the mutex is released.
+func (sess *Session) report(r Receipt) {
+	if handler := sess.ReceiptHandler; handler != nil {
+		sess.later(func() { handler(r) })
+	}
+}
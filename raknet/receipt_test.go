@@ -0,0 +1,59 @@
+package raknet
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReceipts(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sess := new(Session).Init(conn, conn.LocalAddr().(*net.UDPAddr))
+	sess.MTU = 576
+	receipts := make([]Receipt, 0)
+	sess.ReceiptHandler = func(r Receipt) {
+		receipts = append(receipts, r)
+	}
+
+	split, err := sess.SendWithReceipt(bytes.NewReader(make([]byte, 1000)), reliable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.HandleACK([]uint32{0})
+	if err := sess.FlushSendQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 0 {
+		t.Fatalf("Expected no receipts before all parts are ACKed, got %v", receipts)
+	}
+	sess.HandleACK([]uint32{1})
+
+	unreliable, err := sess.SendWithReceipt(bytes.NewReader([]byte("\xfe")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.HandleNACK([]uint32{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sess.SendWithReceipt(bytes.NewReader(nil), reliable); err != ErrEmptyMessage {
+		t.Fatalf("Expected ErrEmptyMessage for an empty message, got %v", err)
+	}
+
+	pending, err := sess.SendWithReceipt(bytes.NewReader([]byte("\xfe")), reliable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	expect := []Receipt{{split, true}, {unreliable, false}, {pending, false}}
+	if !reflect.DeepEqual(receipts, expect) {
+		t.Errorf("Expected receipts %v, got %v", expect, receipts)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package raknet
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort is not supported on this platform.
+func listenReusePort(address string, n int) ([]net.PacketConn, error) {
+	return nil, errors.New("raknet: listener shards are not supported on this platform")
+}
@@ -0,0 +1,64 @@
+package raknet
+
+import (
+	"time"
+)
+
+const (
+	// initialRTO is a retransmission timeout used before the first RTT sample.
+	initialRTO = time.Second
+
+	// minRTO and maxRTO bound the retransmission timeout.
+	minRTO = 100 * time.Millisecond
+	maxRTO = 10 * time.Second
+)
+
+// rttEstimator computes smoothed RTT and retransmission timeout(RTO)
+// from RTT samples, as described in RFC 6298.
+// Zero-valued rttEstimator is ready to use.
+type rttEstimator struct {
+	srtt, rttvar time.Duration
+	rto          time.Duration
+}
+
+// sample updates the estimation with a measured RTT.
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if rtt < 0 {
+		return
+	}
+
+	if e.srtt == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	e.rto = e.srtt + 4*e.rttvar
+	if e.rto < minRTO {
+		e.rto = minRTO
+	} else if e.rto > maxRTO {
+		e.rto = maxRTO
+	}
+}
+
+// timeout returns the retransmission timeout for a datagram
+// which has been resent given times. The timeout doubles on each resend.
+func (e *rttEstimator) timeout(resends int) time.Duration {
+	rto := e.rto
+	if rto == 0 {
+		rto = initialRTO
+	}
+	for i := 0; i < resends && rto < maxRTO; i++ {
+		rto *= 2
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return rto
+}
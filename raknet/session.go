@@ -2,142 +2,129 @@ package raknet
 
 import (
 	"bytes"
+	"errors"
 	"github.com/cr0sh/encore/util/binary"
+	"github.com/cr0sh/encore/util/packet"
+	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
-	"unsafe"
 )
 
 const (
-	// WindowSize is default size of PacketWindow.
+	// WindowSize is default size of Window.
 	WindowSize = 1024
-)
 
-// StreamOption is a option for sending EncapsulatedPackets.
-// Session methods must treat StreamOption as reference and
-// nil StreamOption pointer as 'no option'.
-type StreamOption struct {
-	Queue        bool
-	MessageIndex bool
-	// Disabled if <0 (negative)
-	OrderChannel int
-}
+	// MaxWindowSize is a size Window grows up to, buffering packets received
+	// far out of order. Packets beyond it are not acknowledged, so the peer resends them later.
+	MaxWindowSize = 8 * WindowSize
 
-// PacketWindow is a sized pool for buffering/recovering misordered packet stream.
-// NOTE: pool is a fixed-sized array of unsafe.Pointer, but it can be changed to slice in the future.
-// PacketWindow.Init must be called once for initialization.
-type PacketWindow struct {
-	start, end uint64 // valid range: [start,end)
-	pool       [WindowSize]unsafe.Pointer
-	missing    map[uint64]struct{}
-}
+	// RecvQueueSize is a number of payloads buffered for Session.ReadPacket.
+	// The session is closed with ErrRecvQueueFull if the queue overflows.
+	RecvQueueSize = 1024
 
-// Init initializes PacketWindow.
-// Init returns the PacketWindow itself, so we can define
-// initialized PacketWindow with new(PacketWindow).Init()
-func (window *PacketWindow) Init(trackMissing bool) *PacketWindow {
-	window.end = WindowSize
-	if trackMissing {
-		window.missing = make(map[uint64]struct{})
-	}
+	// OrderChannels is a number of independent order channels.
+	OrderChannels = 32
+)
 
-	return window
-}
+const (
+	// ipUDPHeaderLen is the size of IPv4 and UDP headers, which is a part of MTU.
+	ipUDPHeaderLen = 28
 
-// Put puts given packet(pointer) into pool if its order has
-// a gap between last packet, or does nothing and returns itself.
-//
-// Put returns ordered list of packet(pointer)s to be processed
-// if the packet can be put into the window, otherwise returns nil.
-// The returned slice is valid for use only until the next call.
-//
-// TODO: make time complexity O(1) (currently it is O(WindowSize))
-func (window *PacketWindow) Put(order uint64, ptr unsafe.Pointer) []unsafe.Pointer {
+	// datagramHeaderLen is the size of DataPacket flags and sequence number.
+	datagramHeaderLen = 4
 
-	if order == window.start {
-		ptrs := []unsafe.Pointer{ptr}
-		window.start++
-		window.end++
+	// maxEncapsulatedHeaderLen is the size of a reliable ordered split EncapsulatedPacket header.
+	maxEncapsulatedHeaderLen = 20
+)
 
-		for window.pool[window.start%WindowSize] != nil {
-			ptrs = append(ptrs, window.pool[window.start%WindowSize])
+var (
+	// ErrSessionClosed is returned when reading from a closed Session.
+	ErrSessionClosed = errors.New("raknet: session closed")
 
-			if window.missing != nil {
-				delete(window.missing, window.start)
-			}
-			window.pool[window.start%WindowSize] = nil
-			window.start++
-			window.end++
-		}
-		return ptrs
-	}
+	// ErrTimeout is returned when the remote of a Session stops responding.
+	ErrTimeout = errors.New("raknet: session timed out")
 
-	if order < window.start || order >= window.end {
-		return nil
-	}
+	// ErrDisconnected is returned when the remote closed the Session.
+	ErrDisconnected = errors.New("raknet: session disconnected by remote")
 
-	window.pool[order%WindowSize] = ptr
+	// ErrRecvQueueFull is returned when payloads are not read with ReadPacket
+	// as fast as they arrive, and more than RecvQueueSize of them are queued.
+	ErrRecvQueueFull = errors.New("raknet: receive queue is full")
 
-	if window.missing != nil {
-		delete(window.missing, order)
-		order--
-		for order >= window.start {
-			if _, ok := window.missing[order]; ok ||
-				window.pool[order%WindowSize] != nil {
-				break
-			}
-			window.missing[order] = struct{}{}
-			order--
-		}
-	}
+	// ErrEmptyMessage is returned when sending an empty stream, which has
+	// nothing to be delivered or acknowledged.
+	ErrEmptyMessage = errors.New("raknet: empty message")
+)
 
-	return []unsafe.Pointer{}
+// reliable is a StreamOption used for internal reliable packets.
+var reliable = &StreamOption{MessageIndex: true, OrderChannel: -1, Priority: PriorityHigh}
+
+// unreliable is a StreamOption used for internal keepalive packets.
+var unreliable = &StreamOption{OrderChannel: -1, Priority: PriorityImmediate}
+
+// StreamOption is a option for sending EncapsulatedPackets.
+// Session methods must treat StreamOption as reference and
+// nil StreamOption pointer as 'no option'.
+type StreamOption struct {
+	// Queue makes packets wait in the send queue until the next FlushSendQueue.
+	Queue        bool
+	MessageIndex bool
+	Priority     Priority
+	// OrderChannel is a channel in [0, OrderChannels) for reliable ordered packets.
+	// Packets are delivered in order within the same channel.
+	// Disabled if <0 (negative)
+	OrderChannel int
+	// Sequenced makes packets on OrderChannel sequenced instead of ordered:
+	// packets older than the last delivered one on the channel are discarded.
+	// Sequenced packets are reliable if MessageIndex is set, unreliable otherwise.
+	Sequenced bool
 }
 
-// GetMissing returns missing sequence numbers for window.
-// missing will be reset after call, so callers must process returned list with NACK.
-//
-// If window is initialized with trackMissing == false, GetMissing returns nil immediately.
-func (window *PacketWindow) GetMissing() []uint64 {
-	if window.missing == nil {
-		return nil
-	}
-	m := make([]uint64, len(window.missing))
-	i := 0
-	for order, _ := range window.missing {
-		m[i] = order
-		i++
-	}
-	window.missing = make(map[uint64]struct{})
-	return m
+// recoveryEntry is a sent DataPacket waiting for ACK.
+type recoveryEntry struct {
+	packets  []EncapsulatedPacket
+	size     int
+	sendTime time.Time
+	timeout  time.Time
+
+	// resends is a number of times the packets have been resent.
+	resends int
 }
 
-type splitPool struct {
-	count   uint32
-	packets [][]byte
+// reliableWindow tracks message indexes of received reliable packets
+// to discard duplicates.
+type reliableWindow struct {
+	Window[struct{}]
 }
 
-func (sp *splitPool) put(idx uint32, b []byte) []byte {
-	l := uint32(len(sp.packets))
-	if sp.packets[idx] != nil || idx >= l {
-		return nil
+// accept reports whether the packet with given message index is not received yet,
+// and marks it as received. Indexes too far ahead of the window are not accepted.
+func (w *reliableWindow) accept(idx uint32) bool {
+	if !w.Put(idx, struct{}{}) {
+		return false
 	}
-	sp.packets[idx] = b
-	sp.count++
-	if sp.count == l {
-		b_ := make([]byte, 0)
-		for _, p := range sp.packets {
-			b_ = append(b_, p...)
+	for {
+		if _, ok := w.Pop(); !ok {
+			return true
 		}
-		return b_
 	}
-	return nil
 }
 
 // Session is a set of values for handling single raknet session.
 // Its main implementaion purpose is for servers, but also designed for client uses.
 // Session.Init must be called once for initialization.
+//
+// Methods of Session are safe for concurrent use: exported methods hold a mutex
+// of the session, and unexported ones assume it is held. ReceiptHandler and
+// the owner's close callback are deferred until the mutex is released, so they
+// may call Session methods. Deliveries to ReadPacket never block.
+// Exported fields must be set before the session is shared. Status is updated
+// with the mutex held, so other goroutines must read it with Connected.
 type Session struct {
 	// Status:
 	//  0: recently initialized, haven't sent/received OpenConnectionRequest1
@@ -149,221 +136,638 @@ type Session struct {
 	// ID is a Client's GUID.
 	ID uint64
 
+	// client is set for sessions created by Dial, which send ConnectionRequest.
+	// Other sessions answer it, and become connected by ClientHandshake after that.
+	client bool
+
+	// requested is set when ConnectionRequest of the remote is accepted.
+	requested bool
+
+	// serverID is a GUID of the Listener owning the session.
+	serverID uint64
+
 	StartTime time.Time
 
-	// ServerConn is session owner's Conn socket.
-	ServerConn *net.UDPConn
+	// ServerConn is session owner's socket, which can be any datagram transport
+	// such as *net.UDPConn or PacketPipe. The session only writes to it.
+	ServerConn net.PacketConn
 
 	// Address is a remote endpoint address.
 	Addr *net.UDPAddr
 	MTU  int
 
+	// Congestion controls DataPackets in flight.
+	// If nil, SlidingWindow is used. It must be set before sending packets.
+	Congestion CongestionController
+
+	// config is a Config of the session owner. It can be nil.
+	config *Config
+
+	// ReceiptHandler is called with delivery reports of SendWithReceipt.
+	// It is called from the goroutine handling ACK/NACK without the session
+	// mutex held, so it must not block but may call Session methods.
+	ReceiptHandler func(Receipt)
+
 	sendSplitID      uint16
 	sendMessageIndex uint32
-	sendQueue        []EncapsulatedPacket
+	sendOrderIndex   [OrderChannels]uint32
+	sendSequence     [OrderChannels]uint32
+	sendQueues       [3]sendQueue // high, medium, low
+	credits          [3]int       // remaining weights of current round
+	sendReceiptID    uint32
+	receipts         map[uint32]int // receipt ID -> number of unacknowledged parts
 
-	splitPools map[uint16]splitPool
+	splitPools map[uint16]*splitPool
+	splitBytes int // total bytes of fragments in splitPools
 
 	// EncapsulatedPacket reliability
-	encapsulatedPacketWindow PacketWindow
+	reliableWindow reliableWindow
+	orderWindows   [OrderChannels]Window[[]byte]
+	orderBytes     int                   // total bytes of payloads buffered in orderWindows
+	recvSequence   [OrderChannels]uint32 // next acceptable sequence index
 
 	// DataPacket reliability
 	ackPool, nackPool ACKMap
-	recoveryPool      map[uint32][]EncapsulatedPacket
+	recoveryPool      map[uint32]*recoveryEntry
+	freeEntries       []*recoveryEntry // acknowledged entries for reuse
 	recvSeq, sendSeq  uint32
-	dataPacketWindow  PacketWindow
+	rtt               rttEstimator
+	inFlight          int
+
+	stats Stats
+
+	lastRecv, lastPing time.Time
+
+	recv      chan []byte
+	closed    chan struct{}
+	closeErr  error
+	closeOnce sync.Once
+
+	// onClose is called once with the reason when the session is closed,
+	// so that the session owner(Listener, Dial) can release it.
+	onClose func(err error)
+
+	// writer writes datagrams to ServerConn. It is held while the mutex is
+	// held, so datagrams sent by a method go out in a batch.
+	// Sessions of a Listener shard share the writer.
+	writer *batchWriter
+
+	// recvPacket is reused to decode received DataPackets.
+	recvPacket DataPacket
+
+	// Buffers reused by each send and receive, to avoid allocations.
+	splits   [][]byte
+	encoded  []EncapsulatedPacket
+	packed   []EncapsulatedPacket
+	payloads [][]byte
+	ackKeys  []uint32
+
+	// chunk is the rest of a buffer which own copies payloads into.
+	chunk []byte
+
+	mu        sync.Mutex
+	callbacks []func() // run by unlock after releasing mu
+}
+
+func (sess *Session) lock() {
+	sess.mu.Lock()
+	sess.writer.hold()
+}
+
+// unlock releases the mutex, writes datagrams queued while it was held,
+// and runs callbacks deferred while it was held.
+func (sess *Session) unlock() {
+	callbacks := sess.callbacks
+	sess.callbacks = nil
+	sess.mu.Unlock()
+
+	if err := sess.writer.release(); err != nil {
+		log.WithFields(log.Fields{
+			"addr":  sess.Addr,
+			"error": err,
+		}).Debug("Failed to write datagrams")
+	}
+
+	for _, f := range callbacks {
+		f()
+	}
+}
+
+// later schedules f to run after the mutex is released.
+func (sess *Session) later(f func()) {
+	sess.callbacks = append(sess.callbacks, f)
 }
 
 // Init initializes Session.
 // Init returns the Session itself, so we can define
 // Session with new(Session).Init()
-func (sess *Session) Init(conn *net.UDPConn, addr *net.UDPAddr) *Session {
+func (sess *Session) Init(conn net.PacketConn, addr *net.UDPAddr) *Session {
 	sess.StartTime = time.Now()
+	sess.lastRecv = sess.StartTime
+	sess.lastPing = sess.StartTime
 	sess.ServerConn = conn
+	sess.Addr = addr
+	sess.writer = newBatchWriter(conn)
 
-	sess.sendQueue = make([]EncapsulatedPacket, 0)
+	sess.receipts = make(map[uint32]int)
 
-	sess.splitPools = make(map[uint16]splitPool)
-	sess.encapsulatedPacketWindow.Init(false)
+	sess.splitPools = make(map[uint16]*splitPool)
+	sess.reliableWindow.Init(WindowSize)
+	for i := range sess.orderWindows {
+		sess.orderWindows[i].Init(WindowSize)
+	}
 
 	sess.ackPool = make(ACKMap)
 	sess.nackPool = make(ACKMap)
-	sess.recoveryPool = make(map[uint32][]EncapsulatedPacket)
-	sess.dataPacketWindow.Init(true)
+	sess.recoveryPool = make(map[uint32]*recoveryEntry)
+
+	sess.recv = make(chan []byte, RecvQueueSize)
+	sess.closed = make(chan struct{})
 	return sess
 }
 
-// Send copies b to conn.
+// timestamp returns milliseconds elapsed since StartTime,
+// used in SendPingTime/SendPongTime fields.
+func (sess *Session) timestamp() int64 {
+	return int64(time.Since(sess.StartTime) / time.Millisecond)
+}
+
+// Send copies b to conn. b is not retained after Send returns.
 func (sess *Session) Send(b []byte) error {
-	_, err := sess.ServerConn.WriteToUDP(b, sess.Addr)
-	return err
+	sess.lock()
+	defer sess.unlock()
+	return sess.send(b)
+}
+
+func (sess *Session) send(b []byte) error {
+	sess.stats.BytesSent += uint64(len(b))
+	sess.stats.DatagramsSent++
+	return sess.writer.writeTo(b, sess.Addr)
+}
+
+// congestion returns Congestion, initializing it with SlidingWindow if nil.
+func (sess *Session) congestion() CongestionController {
+	if sess.Congestion == nil {
+		sess.Congestion = &SlidingWindow{MTU: sess.MTU}
+	}
+	return sess.Congestion
 }
 
-// FlushSendQueue sends queued EncapsulatedPackets to Conn and resets sendQueue.
+// maxDatagramLen returns the largest size of a datagram which fits in the MTU.
+func (sess *Session) maxDatagramLen() int {
+	return sess.MTU - ipUDPHeaderLen
+}
+
+// FlushSendQueue sends queued EncapsulatedPackets to Conn as long as
+// the congestion window allows. Packets above the window are left in send queues.
+// Send queues of each priority are scheduled by weighted round-robin.
 func (sess *Session) FlushSendQueue() error {
-	err := sess.SendEncapsulatedPacket(sess.sendQueue...)
-	sess.sendQueue = make([]EncapsulatedPacket, 0)
-	return err
+	sess.lock()
+	defer sess.unlock()
+	return sess.flushSendQueue()
 }
 
-func splitStream(rd io.Reader, mtu int) ([][]byte, error) {
-	bs := make([][]byte, 0)
+func (sess *Session) flushSendQueue() error {
+	for {
+		eps := sess.packed[:0]
+		size := datagramHeaderLen
+		for {
+			i := sess.nextQueue()
+			if i < 0 {
+				break
+			}
+			ep := sess.sendQueues[i].peek()
+			if len(eps) > 0 && size+ep.Len() > sess.maxDatagramLen() {
+				break
+			}
+			if sess.inFlight > 0 && sess.inFlight+size+ep.Len() > sess.congestion().Window() {
+				break
+			}
+
+			sess.sendQueues[i].pop()
+			sess.credits[i]--
+			eps = append(eps, ep)
+			size += ep.Len()
+		}
+		sess.packed = eps
+
+		if len(eps) == 0 {
+			return nil
+		}
+		if err := sess.sendDataPacket(eps, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// splitStream reads rd into payloads fitting in a DataPacket, and appends them to bs.
+func (sess *Session) splitStream(bs [][]byte, rd io.Reader) ([][]byte, error) {
+	size := sess.MTU - ipUDPHeaderLen - datagramHeaderLen - maxEncapsulatedHeaderLen
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = slices.Grow(*buf, size)
+	b := (*buf)[:size]
 	for {
-		b := make([]byte, mtu-34)
 		n, err := io.ReadFull(rd, b)
 		if err == io.ErrUnexpectedEOF {
-			bs = append(bs, b[:n])
+			bs = append(bs, sess.own(b[:n]))
 			break
 		} else if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, err
+			return bs, err
 		}
-		bs = append(bs, b)
+		bs = append(bs, sess.own(b))
 	}
 	return bs, nil
 }
 
+// encapsulateBytes appends EncapsulatedPackets of bs to eps.
+//
 // NOTE: encapsulateBytes has a side-effect that increments
-// Session's sendSplitID and sendSplitindex.
-func (sess *Session) encapsulateBytes(bs [][]byte, option *StreamOption) []EncapsulatedPacket {
-	eps := make([]EncapsulatedPacket, 0, len(bs))
-	if len(bs) > 1 {
-		for i, b := range bs {
-			ep := EncapsulatedPacket{
-				IsSplit:    true,
-				SplitCount: uint32(len(bs)),
-				SplitID:    sess.sendSplitID,
-				SplitIndex: uint32(i),
-
-				Payload: b,
-			}
-			sess.sendSplitID++
-
-			if option != nil && option.MessageIndex {
-				ep.Reliability = 2
-				ep.MessageIndex = sess.sendMessageIndex
-				sess.sendMessageIndex++
-			}
-
-			eps = append(eps, ep)
-		}
-	} else {
+// Session's sendSplitID, sendMessageIndex, sendOrderIndex and sendSequence.
+//
+// Sequenced packets carry the sequence index in OrderIndex field,
+// as the wire format has no separate field for it.
+func (sess *Session) encapsulateBytes(eps []EncapsulatedPacket, bs [][]byte, option *StreamOption) []EncapsulatedPacket {
+	for i, b := range bs {
 		ep := EncapsulatedPacket{
-			Payload: bs[0],
+			Payload: b,
+		}
+
+		if len(bs) > 1 {
+			ep.IsSplit = true
+			ep.SplitCount = uint32(len(bs))
+			ep.SplitID = sess.sendSplitID
+			ep.SplitIndex = uint32(i)
 		}
 
-		if option != nil && option.MessageIndex {
+		if option != nil && option.OrderChannel >= 0 {
+			ep.OrderChannel = byte(option.OrderChannel)
+			if option.Sequenced {
+				ep.Reliability = 1
+				if option.MessageIndex {
+					ep.Reliability = 4
+				}
+				ep.OrderIndex = sess.sendSequence[option.OrderChannel]
+			} else {
+				ep.Reliability = 3
+				ep.OrderIndex = sess.sendOrderIndex[option.OrderChannel]
+			}
+		} else if option != nil && option.MessageIndex {
 			ep.Reliability = 2
+		}
+		if ep.Reliability >= 2 {
 			ep.MessageIndex = sess.sendMessageIndex
-			sess.sendMessageIndex++
+			sess.sendMessageIndex = (sess.sendMessageIndex + 1) & triadMask
 		}
+
 		eps = append(eps, ep)
 	}
 
+	if len(bs) > 1 {
+		sess.sendSplitID++
+	}
+	if option != nil && option.OrderChannel >= 0 {
+		if option.Sequenced {
+			sess.sendSequence[option.OrderChannel] = (sess.sendSequence[option.OrderChannel] + 1) & triadMask
+		} else {
+			sess.sendOrderIndex[option.OrderChannel] = (sess.sendOrderIndex[option.OrderChannel] + 1) & triadMask
+		}
+	}
 	return eps
 }
 
 // SendEncapsulatedStream directly sends given stream with EncapsulatedPacket.
+// Empty streams are not sent, and ErrEmptyMessage is returned.
 func (sess *Session) SendEncapsulatedStream(rd io.Reader, option *StreamOption) error {
-	bs, err := splitStream(rd, sess.MTU)
+	sess.lock()
+	defer sess.unlock()
+	return sess.sendStream(rd, option, 0)
+}
+
+// sendStream sends given stream, tracking it with the receipt ID if not 0.
+func (sess *Session) sendStream(rd io.Reader, option *StreamOption, receipt uint32) error {
+	if option != nil && option.OrderChannel >= OrderChannels {
+		return errors.New("raknet: order channel " + strconv.Itoa(option.OrderChannel) + " out of range")
+	}
+
+	bs, err := sess.splitStream(sess.splits[:0], rd)
+	sess.splits = bs
 	if err != nil {
 		return err
 	}
+	if len(bs) == 0 {
+		return ErrEmptyMessage
+	}
 
-	if option.Queue {
-		sess.sendQueue = append(sess.sendQueue, sess.encapsulateBytes(bs, option)...)
-		return nil
+	eps := sess.encapsulateBytes(sess.encoded[:0], bs, option)
+	sess.encoded = eps
+	if receipt != 0 {
+		for i := range eps {
+			eps[i].receipt = receipt
+		}
+		sess.receipts[receipt] = len(eps)
+	}
+
+	priority := PriorityMedium
+	if option != nil {
+		priority = option.Priority
+	}
+	if priority == PriorityImmediate && !option.Queue {
+		return sess.sendEncapsulatedPacket(eps, 0)
 	}
 
-	return sess.SendEncapsulatedPacket(sess.encapsulateBytes(bs, option)...)
+	sess.enqueue(priority, eps)
+	if option != nil && option.Queue {
+		return nil
+	}
+	return sess.flushSendQueue()
 }
 
 // SendEncapsulatedPacket sends given EncapsulatedPackets with
 // appropriate number of DataPackets.
+// The packets are put after the PriorityMedium send queue, and wait there if
+// the congestion window is full.
 func (sess *Session) SendEncapsulatedPacket(eps ...EncapsulatedPacket) error {
-	length := 0
-	start_idx := 0
-	for idx := range eps {
-		if length+eps[idx].Len()+4 < sess.MTU {
-			length += eps[idx].Len()
-		} else {
-			dp := DataPacket{
-				Seq:     binary.LTriad(sess.sendSeq),
-				Packets: eps[start_idx:idx],
-			}
-			buf := new(bytes.Buffer)
-			if err := binary.Marshal(dp, buf); err != nil {
-				return err
-			}
-
-			sess.recoveryPool[sess.sendSeq] = dp.Packets
-			sess.sendSeq++
+	sess.lock()
+	defer sess.unlock()
+	sess.enqueue(PriorityMedium, eps)
+	return sess.flushSendQueue()
+}
 
-			if err := sess.Send(buf.Bytes()); err != nil {
-				return err
-			}
+// sendEncapsulatedPacket sends eps immediately, regardless of the congestion window.
+// It is used for resends, PriorityImmediate packets and a disconnection notification.
+func (sess *Session) sendEncapsulatedPacket(eps []EncapsulatedPacket, resends int) error {
+	for len(eps) > 0 {
+		n, _ := sess.packDataPacket(eps)
+		if err := sess.sendDataPacket(eps[:n], resends); err != nil {
+			return err
+		}
+		eps = eps[n:]
+	}
+	return nil
+}
 
-			start_idx = idx
+// packDataPacket returns the number of leading EncapsulatedPackets which fit in
+// a single DataPacket, and the size of the DataPacket. It is always at least 1.
+func (sess *Session) packDataPacket(eps []EncapsulatedPacket) (n, size int) {
+	size = datagramHeaderLen
+	for n < len(eps) {
+		if n > 0 && size+eps[n].Len() > sess.maxDatagramLen() {
+			break
 		}
+		size += eps[n].Len()
+		n++
 	}
+	return
+}
 
+// sendDataPacket sends eps in a single DataPacket and puts it into recoveryPool.
+func (sess *Session) sendDataPacket(eps []EncapsulatedPacket, resends int) error {
 	dp := DataPacket{
 		Seq:     binary.LTriad(sess.sendSeq),
-		Packets: eps[start_idx:],
+		Packets: eps,
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = dp.Append(append(*buf, 0x84))
+	size := len(*buf)
+
+	now := time.Now()
+	entry := sess.newEntry()
+	entry.packets = append(entry.packets, eps...)
+	entry.size = size
+	entry.sendTime = now
+	entry.timeout = now.Add(sess.rtt.timeout(resends))
+	entry.resends = resends
+	sess.recoveryPool[sess.sendSeq] = entry
+	sess.inFlight += size
+	sess.congestion().OnSend(sess.sendSeq, size)
+	sess.sendSeq = (sess.sendSeq + 1) & triadMask
+	sess.stats.DataPacketsSent++
+	if resends > 0 {
+		sess.stats.Resends++
 	}
+
+	return sess.send(*buf)
+}
+
+// newEntry returns an empty recoveryEntry, reusing a freed one if any.
+func (sess *Session) newEntry() *recoveryEntry {
+	n := len(sess.freeEntries)
+	if n == 0 {
+		return new(recoveryEntry)
+	}
+	entry := sess.freeEntries[n-1]
+	sess.freeEntries = sess.freeEntries[:n-1]
+	return entry
+}
+
+// freeEntry puts entry removed from recoveryPool back for reuse.
+func (sess *Session) freeEntry(entry *recoveryEntry) {
+	for i := range entry.packets {
+		entry.packets[i] = EncapsulatedPacket{} // drop the references to payloads
+	}
+	*entry = recoveryEntry{packets: entry.packets[:0]}
+	sess.freeEntries = append(sess.freeEntries, entry)
+}
+
+// resend sends reliable packets of the entry again with a new sequence number,
+// and frees the entry. Unreliable packets are dropped, and their receipts are reported as lost.
+func (sess *Session) resend(entry *recoveryEntry) error {
+	defer sess.freeEntry(entry)
+	eps := entry.packets[:0]
+	for _, ep := range entry.packets {
+		if ep.Reliability >= 2 && ep.Reliability != 5 {
+			eps = append(eps, ep)
+		} else if ep.receipt != 0 {
+			sess.receiptLost(ep.receipt)
+		}
+	}
+	return sess.sendEncapsulatedPacket(eps, entry.resends+1)
+}
+
+// ResendExpired resends DataPackets in recoveryPool which are not ACKed
+// until their retransmission timeout. The timeout is estimated from RTT,
+// and doubles each time the same packets are resent.
+//
+// ResendExpired returns ErrTimeout if a DataPacket is expired after
+// Config.MaxResends resends.
+func (sess *Session) ResendExpired(now time.Time) error {
+	sess.lock()
+	defer sess.unlock()
+	return sess.resendExpired(now)
+}
+
+func (sess *Session) resendExpired(now time.Time) error {
+	expired := make([]int, 0)
+	for seq, entry := range sess.recoveryPool {
+		if !now.Before(entry.timeout) {
+			expired = append(expired, int(seq))
+		}
+	}
+	sort.Ints(expired)
+
+	for _, seq := range expired {
+		entry := sess.recoveryPool[uint32(seq)]
+		if entry.resends >= sess.config.maxResends() {
+			return ErrTimeout
+		}
+		delete(sess.recoveryPool, uint32(seq))
+		sess.inFlight -= entry.size
+		sess.stats.DataPacketsLost++
+		sess.congestion().OnLoss(uint32(seq), true)
+		if err := sess.resend(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendPacket marshals given packet with its ID and sends it
+// as a single EncapsulatedPacket stream.
+func (sess *Session) SendPacket(pk packet.Packet, option *StreamOption) error {
+	sess.lock()
+	defer sess.unlock()
+	return sess.sendPacket(pk, option)
+}
+
+func (sess *Session) sendPacket(pk packet.Packet, option *StreamOption) error {
 	buf := new(bytes.Buffer)
-	if err := binary.Marshal(dp, buf); err != nil {
+	if err := packet.Marshal(pk, buf); err != nil {
 		return err
 	}
+	return sess.sendStream(buf, option, 0)
+}
 
-	sess.recoveryPool[sess.sendSeq] = dp.Packets
-	sess.sendSeq++
+// Update runs periodic tasks of the session. It resends expired DataPackets,
+// flushes send queues, and sends ACK/NACK for DataPackets received since the last Update.
+// Connected sessions send ConnectedPing every Config.PingInterval to keep alive.
+// Session owners(Listener, Dial) call Update every Config.UpdateInterval;
+// sessions created manually with Init must be updated by the caller.
+//
+// If nothing is received for Config.Timeout, or the remote stops acknowledging
+// DataPackets, Update closes the session and returns ErrTimeout.
+func (sess *Session) Update(now time.Time) error {
+	sess.lock()
+	defer sess.unlock()
+	return sess.update(now)
+}
 
-	if err := sess.Send(buf.Bytes()); err != nil {
+func (sess *Session) update(now time.Time) error {
+	if now.Sub(sess.lastRecv) > sess.config.timeout() {
+		sess.close(ErrTimeout)
+		return ErrTimeout
+	}
+	if err := sess.resendExpired(now); err != nil {
+		if err == ErrTimeout {
+			sess.close(ErrTimeout)
+		}
 		return err
 	}
-
-	return nil
+	sess.evictSplits(now)
+	if sess.Status == 3 && now.Sub(sess.lastPing) >= sess.config.pingInterval() {
+		sess.lastPing = now
+		if err := sess.sendPacket(&ConnectedPing{SendPingTime: sess.timestamp()}, unreliable); err != nil {
+			return err
+		}
+	}
+	if err := sess.flushSendQueue(); err != nil {
+		return err
+	}
+	if err := sess.sendACK(); err != nil {
+		return err
+	}
+	return sess.sendNACK()
 }
 
 // SendACK packs ackPool into single ACK packet and sends to Conn.
 func (sess *Session) SendACK() error {
-	if len(sess.ackPool) == 0 {
-		return nil
-	}
+	sess.lock()
+	defer sess.unlock()
+	return sess.sendACK()
+}
 
-	buf := new(bytes.Buffer)
-	buf.WriteByte(0xc0)
-	EncodeACK(sess.ackPool, buf)
-	return sess.Send(buf.Bytes())
+func (sess *Session) sendACK() error {
+	return sess.sendACKPool(0xc0, sess.ackPool)
 }
 
 // SendNACK packs nackPool into single NACK packet and sends to Conn.
 func (sess *Session) SendNACK() error {
-	if len(sess.nackPool) == 0 {
+	sess.lock()
+	defer sess.unlock()
+	return sess.sendNACK()
+}
+
+func (sess *Session) sendNACK() error {
+	return sess.sendACKPool(0xa0, sess.nackPool)
+}
+
+// sendACKPool sends keys in pool as an ACK or NACK packet with given ID, and clears pool.
+func (sess *Session) sendACKPool(id byte, pool ACKMap) error {
+	if len(pool) == 0 {
 		return nil
 	}
 
-	buf := new(bytes.Buffer)
-	buf.WriteByte(0xa0)
-	EncodeACK(sess.nackPool, buf)
-	return sess.Send(buf.Bytes())
+	keys := sess.ackKeys[:0]
+	for k := range pool {
+		keys = append(keys, k)
+		delete(pool, k)
+	}
+	sess.ackKeys = keys
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = appendACK(append(*buf, id), keys)
+	return sess.send(*buf)
 }
 
 // HandleACK handles received ACK packet.
+// RTT is sampled from DataPackets which have not been resent(Karn's algorithm).
 func (sess *Session) HandleACK(keys []uint32) {
+	sess.lock()
+	defer sess.unlock()
+	sess.handleACK(keys)
+}
+
+func (sess *Session) handleACK(keys []uint32) {
+	now := time.Now()
 	for _, k := range keys {
-		delete(sess.recoveryPool, k)
+		if entry, ok := sess.recoveryPool[k]; ok {
+			var rtt time.Duration
+			if entry.resends == 0 {
+				rtt = now.Sub(entry.sendTime)
+				sess.rtt.sample(rtt)
+			}
+			delete(sess.recoveryPool, k)
+			sess.inFlight -= entry.size
+			sess.congestion().OnACK(entry.size, rtt)
+			for _, ep := range entry.packets {
+				if ep.receipt != 0 {
+					sess.receiptAcked(ep.receipt)
+				}
+			}
+			sess.freeEntry(entry)
+		}
 	}
 }
 
 // HandleNACK handles received NACK packet.
 func (sess *Session) HandleNACK(keys []uint32) error {
+	sess.lock()
+	defer sess.unlock()
+	return sess.handleNACK(keys)
+}
+
+func (sess *Session) handleNACK(keys []uint32) error {
 	for _, k := range keys {
-		if eps, ok := sess.recoveryPool[k]; ok {
+		if entry, ok := sess.recoveryPool[k]; ok {
 			delete(sess.recoveryPool, k)
-			if err := sess.SendEncapsulatedPacket(eps...); err != nil {
+			sess.inFlight -= entry.size
+			sess.stats.DataPacketsLost++
+			sess.congestion().OnLoss(k, false)
+			if err := sess.resend(entry); err != nil {
 				return err
 			}
 		}
@@ -371,65 +775,342 @@ func (sess *Session) HandleNACK(keys []uint32) error {
 	return nil
 }
 
-func (sess *Session) putSplit(ep EncapsulatedPacket) []byte {
-	if !ep.IsSplit {
-		panic("putSplit only accepts split packets")
-	}
-	pool, ok := sess.splitPools[ep.SplitID]
-	if !ok {
-		pool = splitPool{packets: make([][]byte, ep.SplitCount)}
-		sess.splitPools[ep.SplitID] = pool
-	}
-
-	return pool.put(ep.SplitIndex, ep.Payload)
-}
-
 // HandleDataPacket processes given DataPacket for session and
 // returns list of payloads to be processed.
-func (sess *Session) HandleDataPacket(dp DataPacket) [][]byte {
-	sess.ackPool[uint32(dp.Seq)] = struct{}{}
-	ptrs := sess.dataPacketWindow.Put(uint64(dp.Seq), unsafe.Pointer(&dp))
-	if len(ptrs) == 0 {
-		if ptrs != nil {
-			missing := sess.dataPacketWindow.GetMissing()
-			for _, m := range missing {
-				sess.nackPool[uint32(m)] = struct{}{}
+//
+// DataPackets are processed as soon as they arrive, since lost packets are
+// resent with new sequence numbers. Skipped sequence numbers are put into nackPool.
+// Duplicated reliable packets are discarded, split packets are reassembled, and
+// reliable ordered packets are reordered within each order channel.
+// Sequenced packets older than the last delivered one on its channel are discarded.
+//
+// Split packets with invalid metadata or over the reassembly limits are discarded,
+// and the first error of them is returned with the payloads.
+//
+// Payloads of dp may be slices of a datagram buffer: the session copies those
+// it keeps after returning, and returned payloads may be the ones of dp.
+func (sess *Session) HandleDataPacket(dp DataPacket) ([][]byte, error) {
+	sess.lock()
+	defer sess.unlock()
+	bs, err := sess.handleDataPacket(dp)
+	return append(make([][]byte, 0, len(bs)), bs...), err
+}
+
+// handleDataPacket is HandleDataPacket returning payloads in a slice reused by the next call.
+func (sess *Session) handleDataPacket(dp DataPacket) ([][]byte, error) {
+	// Datagrams are not acknowledged if dropped here, so the peer resends
+	// them after the windows move on.
+	buffered := 0
+	for _, ep := range dp.Packets {
+		if !sess.fits(ep) {
+			log.WithFields(log.Fields{
+				"addr": sess.Addr,
+				"seq":  dp.Seq,
+			}).Debug("Dropped a datagram too far out of order")
+			return nil, nil
+		}
+		if sess.reordered(ep) {
+			buffered += len(ep.Payload)
+		}
+	}
+	if buffered > 0 && sess.orderBytes+buffered > sess.config.maxOrderBytes() {
+		log.WithFields(log.Fields{
+			"addr": sess.Addr,
+			"seq":  dp.Seq,
+		}).Debug("Dropped a datagram over the limit of reordered bytes")
+		return nil, nil
+	}
+	seq := uint32(dp.Seq)
+	sess.ackPool[seq] = struct{}{}
+	delete(sess.nackPool, seq)
+	if triadAhead(seq, sess.recvSeq) {
+		if (seq-sess.recvSeq)&triadMask <= WindowSize {
+			for m := sess.recvSeq; m != seq; m = (m + 1) & triadMask {
+				sess.nackPool[m] = struct{}{}
 			}
 		}
-		return nil
+		sess.recvSeq = (seq + 1) & triadMask
 	}
 
-	bs := make([][]byte, 0)
-	for _, ptr := range ptrs {
-		dp := (*DataPacket)(ptr)
-		for _, ep := range dp.Packets {
-			var ptrs []unsafe.Pointer
-			if ep.Reliability >= 2 && ep.Reliability != 5 {
-				ptrs = sess.encapsulatedPacketWindow.Put(uint64(ep.MessageIndex), unsafe.Pointer(&ep))
+	var err error
+	bs := sess.payloads[:0]
+	defer func() { sess.payloads = bs }()
+	for _, ep := range dp.Packets {
+		if ep.Reliability >= 2 && ep.Reliability != 5 &&
+			!sess.reliableWindow.accept(ep.MessageIndex) {
+			continue
+		}
 
-			} else {
-				ptrs = []unsafe.Pointer{unsafe.Pointer(&ep)}
+		if ep.IsSplit {
+			b, splitErr := sess.putSplit(ep, time.Now())
+			if splitErr != nil && err == nil {
+				err = splitErr
+			}
+			if b == nil {
+				continue
 			}
-			for _, ptr := range ptrs {
-				ep := (*EncapsulatedPacket)(ptr)
-				if ep.IsSplit {
-					if b := sess.putSplit(*ep); b != nil {
-						bs = append(bs, b)
-					}
-				} else {
-					bs = append(bs, ep.Payload)
+			ep.IsSplit = false
+			ep.Payload = b
+		}
+
+		switch ep.Reliability {
+		case 3: // reliability 7 carries no order fields, and is delivered unordered
+			if int(ep.OrderChannel) >= OrderChannels {
+				continue
+			}
+			window := &sess.orderWindows[ep.OrderChannel]
+			if ep.OrderIndex != window.Start() {
+				payload := sess.own(ep.Payload) // buffered until reordered
+				if window.Put(ep.OrderIndex, payload) {
+					sess.orderBytes += len(payload)
 				}
+				continue
 			}
+			if !window.Put(ep.OrderIndex, ep.Payload) {
+				continue
+			}
+			for first := true; ; first = false {
+				b, ok := window.Pop()
+				if !ok {
+					break
+				}
+				if !first {
+					sess.orderBytes -= len(b)
+				}
+				bs = append(bs, b)
+			}
+		case 1, 4:
+			if int(ep.OrderChannel) >= OrderChannels ||
+				!triadAhead(ep.OrderIndex, sess.recvSequence[ep.OrderChannel]) {
+				continue
+			}
+			sess.recvSequence[ep.OrderChannel] = (ep.OrderIndex + 1) & triadMask
+			bs = append(bs, ep.Payload)
+		default:
+			bs = append(bs, ep.Payload)
 		}
 	}
 
-	return bs
+	return bs, err
 }
 
-// Close closes the session.
-func (sess *Session) Close() {
-	sess.SendEncapsulatedPacket(EncapsulatedPacket{
-		Reliability: 0,
-		Payload:     []byte("\x15"),
+// fits reports whether ep fits the reliable and order windows.
+func (sess *Session) fits(ep EncapsulatedPacket) bool {
+	if ep.Reliability >= 2 && ep.Reliability != 5 && !sess.reliableWindow.Fits(ep.MessageIndex) {
+		return false
+	}
+	if ep.Reliability == 3 && int(ep.OrderChannel) < OrderChannels &&
+		!sess.orderWindows[ep.OrderChannel].Fits(ep.OrderIndex) {
+		return false
+	}
+	return true
+}
+
+// reordered reports whether ep is a reliable ordered packet ahead of
+// the next one to be delivered, which is buffered in the order window.
+func (sess *Session) reordered(ep EncapsulatedPacket) bool {
+	return ep.Reliability == 3 && int(ep.OrderChannel) < OrderChannels &&
+		ep.OrderIndex != sess.orderWindows[ep.OrderChannel].Start()
+}
+
+// HandlePacket handles a connected datagram(DataPacket, ACK or NACK) received from Addr.
+// Handshake packets are processed inside, and other payloads are queued for ReadPacket.
+func (sess *Session) HandlePacket(b []byte) error {
+	sess.lock()
+	defer sess.unlock()
+	return sess.handlePacket(b)
+}
+
+func (sess *Session) handlePacket(b []byte) error {
+	if len(b) == 0 || b[0]&0x80 == 0 {
+		return errors.New("raknet: not a connected datagram")
+	}
+
+	sess.lastRecv = time.Now()
+	sess.stats.BytesReceived += uint64(len(b))
+	sess.stats.DatagramsReceived++
+	switch {
+	case b[0]&0x40 != 0: // ACK
+		keys, err := decodeACK(sess.ackKeys[:0], b[1:])
+		sess.ackKeys = keys
+		if err != nil {
+			return err
+		}
+		sess.handleACK(keys)
+		return sess.flushSendQueue()
+	case b[0]&0x20 != 0: // NACK
+		keys, err := decodeACK(sess.ackKeys[:0], b[1:])
+		sess.ackKeys = keys
+		if err != nil {
+			return err
+		}
+		if err := sess.handleNACK(keys); err != nil {
+			return err
+		}
+		return sess.flushSendQueue()
+	default:
+		if err := sess.recvPacket.Decode(b[1:]); err != nil {
+			return err
+		}
+		payloads, splitErr := sess.handleDataPacket(sess.recvPacket)
+		for _, payload := range payloads {
+			if err := sess.handlePayload(payload); err != nil {
+				return err
+			}
+		}
+		return splitErr
+	}
+}
+
+// handlePayload processes connection handshake packets and
+// passes others to ReadPacket.
+func (sess *Session) handlePayload(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	switch b[0] {
+	case 0x00: // ConnectedPing
+		ping := new(ConnectedPing)
+		if err := binary.Unmarshal(ping, bytes.NewReader(b[1:])); err != nil {
+			return err
+		}
+		return sess.sendPacket(&ConnectedPong{
+			SendPingTime: ping.SendPingTime,
+			SendPongTime: sess.timestamp(),
+		}, unreliable)
+	case 0x03: // ConnectedPong
+		pong := new(ConnectedPong)
+		if err := binary.Unmarshal(pong, bytes.NewReader(b[1:])); err != nil {
+			return err
+		}
+		sess.handlePong(pong)
+	case 0x09: // ConnectionRequest
+		if sess.client {
+			return nil
+		}
+		req := new(ConnectionRequest)
+		if err := binary.Unmarshal(req, bytes.NewReader(b[1:])); err != nil {
+			return err
+		}
+		if req.ClientGUID != sess.ID || req.Security {
+			sess.reject(&ConnectionRequestFailed{ServerGUID: sess.serverID}, ErrConnectionRequestFailed)
+			return ErrConnectionRequestFailed
+		}
+		sess.requested = true
+		return sess.sendPacket(&ConnectionRequestAccepted{
+			SystemAddr:   IPAddr(*sess.Addr),
+			SystemAddrs:  localSystemAddresses,
+			SendPingTime: req.SendPingTime,
+			SendPongTime: sess.timestamp(),
+		}, reliable)
+	case 0x10: // ConnectionRequestAccepted
+		if !sess.client || sess.Status == 3 {
+			return nil
+		}
+		hs := new(ConnectionRequestAccepted)
+		if err := binary.Unmarshal(hs, bytes.NewReader(b[1:])); err != nil {
+			return err
+		}
+		if err := sess.sendPacket(&ClientHandshake{
+			ClientAddr:   IPAddr(*sess.Addr),
+			SystemAddrs:  localSystemAddresses,
+			SendPingTime: hs.SendPongTime,
+			SendPongTime: sess.timestamp(),
+		}, reliable); err != nil {
+			return err
+		}
+		sess.Status = 3
+	case 0x13: // ClientHandshake
+		if !sess.client && sess.requested {
+			sess.Status = 3
+		}
+	case 0x11: // ConnectionRequestFailed
+		if sess.client {
+			sess.close(ErrConnectionRequestFailed)
+		}
+	case 0x15: // DisconnectionNotification
+		sess.close(ErrDisconnected)
+	default:
+		if sess.Status != 3 {
+			return nil
+		}
+		// Blocking here would stall the goroutine reading datagrams for
+		// other sessions too, so the session is closed on overflow instead.
+		select {
+		case sess.recv <- sess.own(b): // b is a slice of the datagram buffer
+		default:
+			sess.reject(&DisconnectionNotification{}, ErrRecvQueueFull)
+			return ErrRecvQueueFull
+		}
+	}
+	return nil
+}
+
+// ReadPacket blocks until a payload is received from remote, and returns it.
+// ReadPacket returns the reason(see Err) after the session is closed.
+func (sess *Session) ReadPacket() ([]byte, error) {
+	select {
+	case b := <-sess.recv:
+		return b, nil
+	case <-sess.closed:
+		return nil, sess.closeErr
+	}
+}
+
+// Done returns a channel which is closed when the session is closed.
+func (sess *Session) Done() <-chan struct{} {
+	return sess.closed
+}
+
+// Connected reports whether the session finished the connection handshake(Status 3).
+func (sess *Session) Connected() bool {
+	sess.lock()
+	defer sess.unlock()
+	return sess.Status == 3
+}
+
+// Err returns nil if the session is not closed yet, or the reason of closing:
+// ErrSessionClosed if closed by Close, ErrDisconnected if closed by remote,
+// ErrTimeout if remote stopped responding, and ErrRecvQueueFull if payloads were not read.
+func (sess *Session) Err() error {
+	select {
+	case <-sess.closed:
+		return sess.closeErr
+	default:
+		return nil
+	}
+}
+
+// close releases the session with the reason without notifying remote.
+func (sess *Session) close(err error) {
+	sess.closeOnce.Do(func() {
+		sess.closeErr = err
+		close(sess.closed)
+		sess.dropReceipts()
+		if sess.onClose != nil {
+			sess.later(func() { sess.onClose(err) })
+		}
 	})
 }
+
+// Close notifies remote with DisconnectionNotification, and closes the session.
+func (sess *Session) Close() {
+	sess.lock()
+	defer sess.unlock()
+	sess.reject(&DisconnectionNotification{}, ErrSessionClosed)
+}
+
+// reject sends pk to remote without reliability, and closes the session with err.
+func (sess *Session) reject(pk packet.Packet, err error) {
+	select {
+	case <-sess.closed:
+		return
+	default:
+	}
+	buf := new(bytes.Buffer)
+	if packet.Marshal(pk, buf) == nil {
+		sess.sendEncapsulatedPacket([]EncapsulatedPacket{{Payload: buf.Bytes()}}, 0)
+	}
+	sess.close(err)
+}
@@ -1,110 +1,486 @@
 package raknet
 
 import (
+	"bytes"
+	"github.com/cr0sh/encore/util/binary"
+	"github.com/cr0sh/encore/util/packet"
+	"net"
 	"reflect"
 	"testing"
-	"unsafe"
+	"time"
 )
 
-func TestPacketWindow(t *testing.T) {
-	type input struct {
-		order uint64
-		ptr   unsafe.Pointer
+func TestWindow(t *testing.T) {
+	cases := []struct {
+		start  uint32 // first index of the window
+		put    []uint32
+		accept []bool
+		expect []uint32 // popped after puts
+	}{
+		{0, []uint32{0}, []bool{true}, []uint32{0}},
+		{0, []uint32{99999, 0, 0}, []bool{false, true, false}, []uint32{0}},
+		{0, []uint32{4, 2}, []bool{true, true}, nil},
+		{0, []uint32{4, 2, 3, 1, 0}, []bool{true, true, true, true, true}, []uint32{0, 1, 2, 3, 4}},
+		{0, []uint32{WindowSize - 1, WindowSize, MaxWindowSize - 1, MaxWindowSize}, []bool{true, true, true, false}, nil},
+		{triadMask - 1, []uint32{1, triadMask, 0, triadMask - 1}, []bool{true, true, true, true},
+			[]uint32{triadMask - 1, triadMask, 0, 1}},
+		{1, []uint32{0, triadMask}, []bool{false, false}, nil},
+	}
+
+	for i, c := range cases {
+		window := new(Window[uint32]).Init(WindowSize)
+		window.start = c.start
+
+		for j, idx := range c.put {
+			if ok := window.Put(idx, idx); ok != c.accept[j] {
+				t.Errorf("Test #%d: expected Put(%d) %v, got %v", i, idx, c.accept[j], ok)
+			}
+		}
+		var popped []uint32
+		for {
+			v, ok := window.Pop()
+			if !ok {
+				break
+			}
+			popped = append(popped, v)
+		}
+		if !reflect.DeepEqual(popped, c.expect) {
+			t.Errorf("Test #%d: expected %v, got %v", i, c.expect, popped)
+		}
+	}
+}
+
+func TestResendExpired(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sess := new(Session).Init(conn, conn.LocalAddr().(*net.UDPAddr))
+	sess.MTU = DefaultMTU
+	if err := sess.SendEncapsulatedStream(bytes.NewReader([]byte("\xfedata")), reliable); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if err := sess.ResendExpired(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sess.recoveryPool[0]; !ok {
+		t.Fatal("DataPacket is resent before timeout")
+	}
+
+	for i := 1; i <= 3; i++ {
+		now = now.Add(maxRTO)
+		if err := sess.ResendExpired(now); err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := sess.recoveryPool[uint32(i)]
+		if !ok || len(sess.recoveryPool) != 1 {
+			t.Fatalf("Resend #%d: expected DataPacket #%d in recoveryPool, got %v", i, i, sess.recoveryPool)
+		}
+		if entry.resends != i || entry.packets[0].MessageIndex != 0 {
+			t.Fatalf("Resend #%d: unexpected entry %+v", i, entry)
+		}
+		if expect := initialRTO << uint(i); entry.timeout.Sub(entry.sendTime) != expect {
+			t.Errorf("Resend #%d: expected timeout %v, got %v", i, expect, entry.timeout.Sub(entry.sendTime))
+		}
+	}
+
+	sess.HandleACK([]uint32{3})
+	if len(sess.recoveryPool) != 0 || sess.rtt.srtt != 0 {
+		t.Errorf("Expected empty recoveryPool without RTT sample, got %v, srtt %v", sess.recoveryPool, sess.rtt.srtt)
+	}
+}
+
+func TestOrderChannels(t *testing.T) {
+	sender := new(Session).Init(nil, nil)
+	sender.MTU = 576
+	receiver := new(Session).Init(nil, nil)
+
+	long := bytes.Repeat([]byte("a2"), 1000)
+	messages := []struct {
+		payload []byte
+		channel int
+	}{
+		{[]byte("a0"), 0},
+		{[]byte("a1"), 0},
+		{[]byte("b0"), 1},
+		{long, 0},
+	}
+	eps := make([][]EncapsulatedPacket, len(messages))
+	for i, m := range messages {
+		bs, err := sender.splitStream(nil, bytes.NewReader(m.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		eps[i] = sender.encapsulateBytes(nil, bs, &StreamOption{OrderChannel: m.channel})
+	}
+	if len(eps[3]) < 2 || eps[3][0].SplitID != eps[3][1].SplitID || eps[3][0].OrderIndex != 2 {
+		t.Fatalf("Unexpected split packets %v", eps[3])
+	}
+
+	reversed := make([]EncapsulatedPacket, 0, len(eps[3]))
+	for i := len(eps[3]) - 1; i >= 0; i-- {
+		reversed = append(reversed, eps[3][i])
 	}
 
-	ns := []int{1, 2, 3, 4, 5}
 	cases := []struct {
-		put    input
-		expect []unsafe.Pointer
+		packets []EncapsulatedPacket
+		expect  [][]byte
 	}{
-		{
-			put: input{
-				order: 0,
-				ptr:   unsafe.Pointer(&ns[0]),
-			},
-			expect: []unsafe.Pointer{unsafe.Pointer(&ns[0])},
-		},
-		{
-			put: input{
-				order: 99999,
-				ptr:   unsafe.Pointer(&ns[1]),
-			},
-			expect: nil,
-		},
-		{
-			put: input{
-				order: 0,
-				ptr:   unsafe.Pointer(&ns[0]),
-			},
-			expect: nil,
-		},
-		{
-			put: input{
-				order: 4,
-				ptr:   unsafe.Pointer(&ns[4]),
-			},
-			expect: []unsafe.Pointer{},
-		},
-
-		{
-			put: input{
-				order: 2,
-				ptr:   unsafe.Pointer(&ns[2]),
-			},
-			expect: []unsafe.Pointer{},
-		},
-		{
-			put: input{
-				order: 3,
-				ptr:   unsafe.Pointer(&ns[3]),
-			},
-			expect: []unsafe.Pointer{},
-		},
-		{
-			put: input{
-				order: 1,
-				ptr:   unsafe.Pointer(&ns[1]),
-			},
-			expect: []unsafe.Pointer{
-				unsafe.Pointer(&ns[1]),
-				unsafe.Pointer(&ns[2]),
-				unsafe.Pointer(&ns[3]),
-				unsafe.Pointer(&ns[4]),
-			},
-		},
-	}
-
-	window := new(PacketWindow).Init(true)
+		{eps[1], [][]byte{}},
+		{eps[2], [][]byte{[]byte("b0")}},
+		{eps[1], [][]byte{}},
+		{reversed, [][]byte{}},
+		{eps[0], [][]byte{[]byte("a0"), []byte("a1"), long}},
+	}
 	for i, c := range cases {
-		if ret := window.Put(c.put.order, c.put.ptr); !reflect.DeepEqual(ret, c.expect) {
-			t.Errorf("Test #%d: expected %v,\ngot %v", i, c.expect, ret)
-			return
-		}
-		switch i {
-		case 3:
-			if !reflect.DeepEqual(window.missing, map[uint64]struct{}{
-				1: struct{}{},
-				2: struct{}{},
-				3: struct{}{},
-			}) {
-				t.Errorf("Test 3: GetMissing() mismatch: got %v", window.missing)
-				return
+		ret, err := receiver.HandleDataPacket(DataPacket{Seq: binary.LTriad(i), Packets: c.packets})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ret, c.expect) {
+			t.Fatalf("Test #%d: expected %q,\ngot %q", i, c.expect, ret)
+		}
+	}
+}
+
+func TestSequencedChannels(t *testing.T) {
+	sender := new(Session).Init(nil, nil)
+	sender.MTU = DefaultMTU
+	receiver := new(Session).Init(nil, nil)
+
+	options := []*StreamOption{
+		{OrderChannel: 0, Sequenced: true},
+		{OrderChannel: 0, Sequenced: true, MessageIndex: true},
+		{OrderChannel: 0, Sequenced: true},
+		{OrderChannel: 1, Sequenced: true},
+	}
+	eps := make([]EncapsulatedPacket, len(options))
+	for i, option := range options {
+		eps[i] = sender.encapsulateBytes(nil, [][]byte{{byte(i)}}, option)[0]
+	}
+	if eps[0].Reliability != 1 || eps[1].Reliability != 4 || eps[1].OrderIndex != 1 || eps[3].OrderIndex != 0 {
+		t.Fatalf("Unexpected sequenced packets %v", eps)
+	}
+
+	cases := []struct {
+		ep     EncapsulatedPacket
+		expect [][]byte
+	}{
+		{eps[1], [][]byte{{1}}},
+		{eps[0], [][]byte{}},
+		{eps[3], [][]byte{{3}}},
+		{eps[2], [][]byte{{2}}},
+		{eps[1], [][]byte{}},
+	}
+	for i, c := range cases {
+		ret, err := receiver.HandleDataPacket(DataPacket{Seq: binary.LTriad(i), Packets: []EncapsulatedPacket{c.ep}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ret, c.expect) {
+			t.Fatalf("Test #%d: expected %v,\ngot %v", i, c.expect, ret)
+		}
+	}
+}
+
+func TestSequenceWrap(t *testing.T) {
+	sender := new(Session).Init(nil, nil)
+	sender.MTU = DefaultMTU
+	receiver := new(Session).Init(nil, nil)
+
+	sender.sendMessageIndex = triadMask - 1
+	sender.sendOrderIndex[0] = triadMask - 1
+	receiver.reliableWindow.start = triadMask - 1
+	receiver.orderWindows[0].start = triadMask - 1
+	receiver.recvSeq = triadMask - 1
+
+	eps := make([]EncapsulatedPacket, 4)
+	for i := range eps {
+		eps[i] = sender.encapsulateBytes(nil, [][]byte{{byte(i)}}, &StreamOption{MessageIndex: true, OrderChannel: 0})[0]
+	}
+	if eps[2].MessageIndex != 0 || eps[3].OrderIndex != 1 {
+		t.Fatalf("Expected indexes wrapped around, got %v", eps)
+	}
+
+	cases := []struct {
+		seq    uint32
+		ep     EncapsulatedPacket
+		expect [][]byte
+	}{
+		{1, eps[3], [][]byte{}},
+		{triadMask, eps[1], [][]byte{}},
+		{triadMask, eps[1], [][]byte{}},
+		{triadMask - 1, eps[0], [][]byte{{0}, {1}}},
+		{0, eps[2], [][]byte{{2}, {3}}},
+	}
+	for i, c := range cases {
+		ret, err := receiver.HandleDataPacket(DataPacket{Seq: binary.LTriad(c.seq), Packets: []EncapsulatedPacket{c.ep}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ret, c.expect) {
+			t.Fatalf("Test #%d: expected %v,\ngot %v", i, c.expect, ret)
+		}
+		if i == 0 && !reflect.DeepEqual(receiver.nackPool, ACKMap{triadMask - 1: {}, triadMask: {}, 0: {}}) {
+			t.Errorf("Test #%d: unexpected nackPool %v", i, receiver.nackPool)
+		}
+	}
+	if receiver.recvSeq != 2 || len(receiver.nackPool) != 0 {
+		t.Errorf("Expected recvSeq 2 and empty nackPool, got %d, %v", receiver.recvSeq, receiver.nackPool)
+	}
+}
+
+func TestReorderBeyondWindow(t *testing.T) {
+	sender := new(Session).Init(nil, nil)
+	sender.MTU = DefaultMTU
+	receiver := new(Session).Init(nil, nil)
+
+	const n = WindowSize + 100
+	eps := make([]EncapsulatedPacket, n)
+	for i := range eps {
+		eps[i] = sender.encapsulateBytes(nil, [][]byte{{byte(i)}}, &StreamOption{MessageIndex: true, OrderChannel: 0})[0]
+	}
+	far := sender.encapsulateBytes(nil, [][]byte{{0}}, &StreamOption{MessageIndex: true, OrderChannel: 0})[0]
+	far.MessageIndex, far.OrderIndex = MaxWindowSize+10, MaxWindowSize+10
+
+	// The first few messages are delivered in order, then the next one is lost
+	// and delivered after the others.
+	const lost = 5
+	order := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		if i != lost {
+			order = append(order, i)
+		}
+	}
+	order = append(order, lost)
+
+	var got [][]byte
+	for seq, i := range order {
+		ret, err := receiver.HandleDataPacket(DataPacket{Seq: binary.LTriad(seq), Packets: []EncapsulatedPacket{eps[i]}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ret...)
+
+		if seq == n/2 {
+			ret, err := receiver.HandleDataPacket(DataPacket{Seq: n, Packets: []EncapsulatedPacket{far}})
+			if err != nil || len(ret) != 0 {
+				t.Fatalf("Expected nothing delivered beyond MaxWindowSize, got %v, %v", ret, err)
 			}
-		case 4:
-			if !reflect.DeepEqual(window.missing, map[uint64]struct{}{
-				1: struct{}{},
-				3: struct{}{},
-			}) {
-				t.Errorf("Test 4: GetMissing() mismatch: got %v", window.missing)
-				return
+			if _, ok := receiver.ackPool[n]; ok {
+				t.Fatal("Expected datagram beyond MaxWindowSize not acknowledged")
 			}
-		case 5:
-			if !reflect.DeepEqual(window.missing, map[uint64]struct{}{
-				1: struct{}{},
-			}) {
-				t.Errorf("Test 5: GetMissing() mismatch: got %v", window.missing)
-				return
+		}
+	}
+
+	if len(got) != n {
+		t.Fatalf("Expected %d payloads, got %d", n, len(got))
+	}
+	for i, b := range got {
+		if !bytes.Equal(b, []byte{byte(i)}) {
+			t.Fatalf("Payload #%d: expected %v, got %v", i, []byte{byte(i)}, b)
+		}
+	}
+}
+
+func TestReliableWithReceipt(t *testing.T) {
+	receiver := new(Session).Init(nil, nil)
+	for i := 0; i < 3; i++ {
+		ep := EncapsulatedPacket{Reliability: 7, MessageIndex: uint32(i), Payload: []byte{byte(i)}}
+		b := ep.Append(nil)
+		if _, err := ep.Decode(b); err != nil {
+			t.Fatal(err)
+		}
+		ret, err := receiver.HandleDataPacket(DataPacket{Seq: binary.LTriad(i), Packets: []EncapsulatedPacket{ep}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := [][]byte{{byte(i)}}; !reflect.DeepEqual(ret, expect) {
+			t.Errorf("Test #%d: expected %v, got %v", i, expect, ret)
+		}
+	}
+}
+
+func TestReorderFlood(t *testing.T) {
+	sender := new(Session).Init(nil, nil)
+	sender.MTU = DefaultMTU
+	receiver := new(Session).Init(nil, nil)
+	receiver.config = &Config{MaxOrderBytes: 1000}
+
+	payload := make([]byte, 100)
+	eps := make([][]EncapsulatedPacket, OrderChannels)
+	for ch := range eps {
+		for i := 0; i < 20; i++ {
+			eps[ch] = sender.encapsulateBytes(eps[ch], [][]byte{payload}, &StreamOption{MessageIndex: true, OrderChannel: ch})
+		}
+	}
+
+	// Everything but the first packet of each channel is sent.
+	seq := 0
+	for ch := range eps {
+		for _, ep := range eps[ch][1:] {
+			ret, err := receiver.HandleDataPacket(DataPacket{Seq: binary.LTriad(seq), Packets: []EncapsulatedPacket{ep}})
+			if err != nil || len(ret) != 0 {
+				t.Fatalf("Expected nothing delivered, got %v, %v", ret, err)
+			}
+			_, acked := receiver.ackPool[uint32(seq)]
+			if expect := seq < 10; acked != expect {
+				t.Errorf("Datagram %d: expected acknowledged %v, got %v", seq, expect, acked)
 			}
+			seq++
+		}
+	}
+	if receiver.orderBytes != 1000 {
+		t.Errorf("Expected 1000 bytes buffered, got %d", receiver.orderBytes)
+	}
+
+	ret, err := receiver.HandleDataPacket(DataPacket{Seq: binary.LTriad(seq), Packets: []EncapsulatedPacket{eps[0][0]}})
+	if err != nil || len(ret) != 11 {
+		t.Fatalf("Expected 11 payloads delivered, got %d, %v", len(ret), err)
+	}
+	if receiver.orderBytes != 0 {
+		t.Errorf("Expected no bytes buffered after delivery, got %d", receiver.orderBytes)
+	}
+}
+
+func TestHandshakeState(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	marshal := func(pk packet.Packet) []byte {
+		buf := new(bytes.Buffer)
+		if err := packet.Marshal(pk, buf); err != nil {
+			t.Fatal(err)
 		}
+		return buf.Bytes()
+	}
+	request := marshal(&ConnectionRequest{ClientGUID: 1})
+	accepted := marshal(&ConnectionRequestAccepted{SystemAddr: IPAddr(*addr), SystemAddrs: localSystemAddresses})
+	handshake := marshal(&ClientHandshake{ClientAddr: IPAddr(*addr), SystemAddrs: localSystemAddresses})
+
+	cases := []struct {
+		client   bool
+		payloads [][]byte
+		expect   int // Status after payloads
+	}{
+		{false, [][]byte{handshake}, 2},
+		{false, [][]byte{accepted}, 2},
+		{false, [][]byte{request, accepted}, 2},
+		{false, [][]byte{request, handshake}, 3},
+		{true, [][]byte{handshake}, 2},
+		{true, [][]byte{request, handshake}, 2},
+		{true, [][]byte{accepted}, 3},
+	}
+	for i, c := range cases {
+		sess := new(Session).Init(conn, addr)
+		sess.MTU = DefaultMTU
+		sess.ID = 1
+		sess.client = c.client
+		sess.Status = 2
+		for _, b := range c.payloads {
+			if err := sess.handlePayload(b); err != nil {
+				t.Fatalf("Test #%d: %v", i, err)
+			}
+		}
+		if sess.Status != c.expect {
+			t.Errorf("Test #%d: expected Status %d, got %d", i, c.expect, sess.Status)
+		}
+	}
+}
+
+func TestSessionUpdate(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sess := new(Session).Init(conn, conn.LocalAddr().(*net.UDPAddr))
+	sess.config = &Config{MaxResends: 2, Timeout: time.Hour}
+	sess.MTU = DefaultMTU
+
+	sess.HandleDataPacket(DataPacket{Seq: 2})
+	if err := sess.SendEncapsulatedStream(bytes.NewReader([]byte("\xfedata")),
+		&StreamOption{MessageIndex: true, OrderChannel: -1, Queue: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if err := sess.Update(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(sess.ackPool) != 0 || len(sess.nackPool) != 0 || sess.queued() != 0 || len(sess.recoveryPool) != 1 {
+		t.Fatalf("Expected ACK/NACK sent and queue flushed, got ackPool %v, nackPool %v, %d queued",
+			sess.ackPool, sess.nackPool, sess.queued())
+	}
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(maxRTO)
+		if err := sess.Update(now); err != nil {
+			t.Fatalf("Resend #%d: %v", i, err)
+		}
+	}
+	now = now.Add(maxRTO)
+	if err := sess.Update(now); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if _, err := sess.ReadPacket(); err != ErrTimeout {
+		t.Errorf("Expected session timed out, got %v", err)
+	}
+}
+
+// BenchmarkSession sends a reliable ordered message over PacketPipe,
+// delivers it to ReadPacket, and acknowledges it.
+func BenchmarkSession(b *testing.B) {
+	a, c := PacketPipe()
+	defer a.Close()
+	defer c.Close()
+
+	sender := new(Session).Init(a, c.LocalAddr().(*net.UDPAddr))
+	receiver := new(Session).Init(c, a.LocalAddr().(*net.UDPAddr))
+	sender.MTU, receiver.MTU = DefaultMTU, DefaultMTU
+	sender.Status, receiver.Status = 3, 3
+
+	option := &StreamOption{MessageIndex: true, OrderChannel: 0}
+	payload := bytes.Repeat([]byte{0xfe}, 100)
+	rd := bytes.NewReader(nil)
+	buf := make([]byte, maxDatagramSize)
+	transfer := func(conn net.PacketConn, sess *Session) {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := sess.HandlePacket(buf[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rd.Reset(payload)
+		if err := sender.SendEncapsulatedStream(rd, option); err != nil {
+			b.Fatal(err)
+		}
+		transfer(c, receiver)
+		if p, err := receiver.ReadPacket(); err != nil || len(p) != len(payload) {
+			b.Fatalf("Expected %d bytes, got %d, %v", len(payload), len(p), err)
+		}
+
+		if err := receiver.SendACK(); err != nil {
+			b.Fatal(err)
+		}
+		transfer(a, sender)
+	}
+	if len(sender.recoveryPool) != 0 {
+		b.Fatalf("Expected all DataPackets acknowledged, got %d in flight", len(sender.recoveryPool))
 	}
 }
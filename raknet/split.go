@@ -0,0 +1,93 @@
+package raknet
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidSplit is returned when a split packet has invalid metadata.
+	ErrInvalidSplit = errors.New("raknet: invalid split packet")
+
+	// ErrSplitLimit is returned when a split packet exceeds the reassembly limits of Config.
+	ErrSplitLimit = errors.New("raknet: split packet reassembly limit exceeded")
+)
+
+type splitPool struct {
+	count   uint32
+	size    int
+	packets [][]byte
+	created time.Time
+}
+
+// put stores a fragment at idx, and returns the reassembled payload if
+// all fragments are stored. Duplicated fragments are ignored.
+func (sp *splitPool) put(idx uint32, b []byte) []byte {
+	if sp.packets[idx] != nil {
+		return nil
+	}
+	sp.packets[idx] = append([]byte(nil), b...) // b may be a slice of the datagram buffer
+	sp.count++
+	sp.size += len(b)
+	if sp.count == uint32(len(sp.packets)) {
+		b_ := make([]byte, 0, sp.size)
+		for _, p := range sp.packets {
+			b_ = append(b_, p...)
+		}
+		return b_
+	}
+	return nil
+}
+
+// putSplit puts a fragment into its splitPool, and returns the reassembled
+// payload if completed. Fragments which have invalid metadata or exceed the
+// limits of Config are discarded with an error.
+func (sess *Session) putSplit(ep EncapsulatedPacket, now time.Time) ([]byte, error) {
+	if ep.SplitIndex >= ep.SplitCount {
+		return nil, ErrInvalidSplit
+	}
+	if ep.SplitCount > uint32(sess.config.maxSplitCount()) {
+		return nil, ErrSplitLimit
+	}
+
+	pool, ok := sess.splitPools[ep.SplitID]
+	if !ok {
+		if len(sess.splitPools) >= sess.config.maxSplitPools() {
+			return nil, ErrSplitLimit
+		}
+		pool = &splitPool{packets: make([][]byte, ep.SplitCount), created: now}
+		sess.splitPools[ep.SplitID] = pool
+	} else if uint32(len(pool.packets)) != ep.SplitCount {
+		return nil, ErrInvalidSplit
+	}
+
+	if sess.splitBytes+len(ep.Payload) > sess.config.maxSplitBytes() {
+		sess.dropSplit(ep.SplitID)
+		return nil, ErrSplitLimit
+	}
+
+	size := pool.size
+	b := pool.put(ep.SplitIndex, ep.Payload)
+	sess.splitBytes += pool.size - size
+	if b != nil {
+		sess.dropSplit(ep.SplitID)
+	}
+	return b, nil
+}
+
+// dropSplit removes the splitPool of id.
+func (sess *Session) dropSplit(id uint16) {
+	if pool, ok := sess.splitPools[id]; ok {
+		sess.splitBytes -= pool.size
+		delete(sess.splitPools, id)
+	}
+}
+
+// evictSplits removes incomplete splitPools older than Config.SplitTimeout.
+func (sess *Session) evictSplits(now time.Time) {
+	for id, pool := range sess.splitPools {
+		if now.Sub(pool.created) > sess.config.splitTimeout() {
+			sess.dropSplit(id)
+		}
+	}
+}
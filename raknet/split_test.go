@@ -0,0 +1,53 @@
+package raknet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitLimits(t *testing.T) {
+	sess := new(Session).Init(nil, nil)
+	sess.config = &Config{MaxSplitPools: 2, MaxSplitCount: 4, MaxSplitBytes: 10, SplitTimeout: time.Second}
+
+	split := func(id uint16, count, idx uint32, payload string) EncapsulatedPacket {
+		return EncapsulatedPacket{
+			IsSplit:    true,
+			SplitID:    id,
+			SplitCount: count,
+			SplitIndex: idx,
+			Payload:    []byte(payload),
+		}
+	}
+	cases := []struct {
+		ep     EncapsulatedPacket
+		expect string
+		err    error
+	}{
+		{split(0, 2, 2, "a"), "", ErrInvalidSplit},
+		{split(0, 0, 0, "a"), "", ErrInvalidSplit},
+		{split(0, 5, 0, "a"), "", ErrSplitLimit},
+		{split(0, 2, 0, "ab"), "", nil},
+		{split(0, 3, 1, "cd"), "", ErrInvalidSplit},
+		{split(1, 2, 0, "ef"), "", nil},
+		{split(2, 2, 0, "gh"), "", ErrSplitLimit},
+		{split(0, 2, 0, "ab"), "", nil},
+		{split(0, 2, 1, "cd"), "abcd", nil},
+		{split(2, 2, 0, "ghijklmnop"), "", ErrSplitLimit},
+		{split(2, 2, 0, "gh"), "", nil},
+	}
+
+	for i, c := range cases {
+		b, err := sess.putSplit(c.ep, time.Now())
+		if string(b) != c.expect || err != c.err {
+			t.Errorf("Test #%d: expected %q(error %v), got %q(error %v)", i, c.expect, c.err, b, err)
+		}
+	}
+	if len(sess.splitPools) != 2 || sess.splitBytes != 4 {
+		t.Errorf("Expected 2 pools of 4 bytes, got %d pools of %d bytes", len(sess.splitPools), sess.splitBytes)
+	}
+
+	sess.evictSplits(time.Now().Add(2 * time.Second))
+	if len(sess.splitPools) != 0 || sess.splitBytes != 0 {
+		t.Errorf("Expected stale pools evicted, got %d pools of %d bytes", len(sess.splitPools), sess.splitBytes)
+	}
+}
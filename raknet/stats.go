@@ -0,0 +1,54 @@
+package raknet
+
+import (
+	"time"
+)
+
+// Stats is a snapshot of connection quality and traffic of a Session.
+type Stats struct {
+	// Latency is a smoothed round-trip time, and Jitter is its mean deviation.
+	Latency, Jitter time.Duration
+
+	// LossRatio is a ratio of DataPackets lost(NACKed or timed out) to
+	// DataPackets sent, including resends.
+	LossRatio float64
+
+	BytesSent, BytesReceived         uint64
+	DatagramsSent, DatagramsReceived uint64
+
+	// DataPacketsSent counts sent DataPackets only, excluding ACK/NACK.
+	DataPacketsSent uint64
+	DataPacketsLost uint64
+	Resends         uint64
+}
+
+// Latency returns a smoothed round-trip time to remote, measured from
+// ConnectedPing/ConnectedPong timestamps and ACK arrival times.
+// It returns 0 before the first measurement.
+func (sess *Session) Latency() time.Duration {
+	sess.lock()
+	defer sess.unlock()
+	return sess.rtt.srtt
+}
+
+// Stats returns a snapshot of connection quality and traffic counters.
+func (sess *Session) Stats() Stats {
+	sess.lock()
+	defer sess.unlock()
+	s := sess.stats
+	s.Latency = sess.rtt.srtt
+	s.Jitter = sess.rtt.rttvar
+	if s.DataPacketsSent > 0 {
+		s.LossRatio = float64(s.DataPacketsLost) / float64(s.DataPacketsSent)
+	}
+	return s
+}
+
+// handlePong samples RTT from a ConnectedPong replied to our ConnectedPing.
+func (sess *Session) handlePong(pong *ConnectedPong) {
+	rtt := sess.timestamp() - pong.SendPingTime
+	if rtt < 0 {
+		return
+	}
+	sess.rtt.sample(time.Duration(rtt) * time.Millisecond)
+}
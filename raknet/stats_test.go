@@ -0,0 +1,53 @@
+package raknet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sess := new(Session).Init(conn, conn.LocalAddr().(*net.UDPAddr))
+	sess.MTU = DefaultMTU
+	if s := sess.Stats(); s.Latency != 0 || s.LossRatio != 0 {
+		t.Fatalf("Expected zero stats, got %+v", s)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := sess.SendEncapsulatedStream(bytes.NewReader([]byte("\xfedata")), reliable); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sess.HandleNACK([]uint32{0}); err != nil {
+		t.Fatal(err)
+	}
+	sess.HandleACK([]uint32{1, 2, 3, 4})
+
+	s := sess.Stats()
+	if s.DataPacketsSent != 5 || s.DataPacketsLost != 1 || s.Resends != 1 {
+		t.Errorf("Expected 5 sent, 1 lost, 1 resent, got %+v", s)
+	}
+	if s.LossRatio != 0.2 {
+		t.Errorf("Expected loss ratio 0.2, got %v", s.LossRatio)
+	}
+	if s.DatagramsSent != 5 || s.BytesSent == 0 {
+		t.Errorf("Expected 5 datagrams sent, got %d(%d bytes)", s.DatagramsSent, s.BytesSent)
+	}
+	if s.Latency <= 0 || s.Latency > time.Second {
+		t.Errorf("Expected latency sampled from ACK, got %v", s.Latency)
+	}
+
+	sess.rtt = rttEstimator{}
+	sess.StartTime = time.Now().Add(-time.Second)
+	sess.handlePong(&ConnectedPong{SendPingTime: 900})
+	if l := sess.Latency(); l < 100*time.Millisecond || l > 200*time.Millisecond {
+		t.Errorf("Expected latency about 100ms from pong, got %v", l)
+	}
+}
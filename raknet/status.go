@@ -0,0 +1,114 @@
+package raknet
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ServerStatus is a Bedrock server status sent as UnconnectedPong.ServerName.
+// It is encoded as semicolon-separated fields:
+//
+//	Edition;MOTD;ProtocolVersion;Version;Online;Max;ServerID;SubMOTD;GameMode;GameModeID;PortV4;PortV6;
+type ServerStatus struct {
+	// Edition is "MCPE" for Bedrock Edition, or "MCEE" for Education Edition.
+	Edition string
+
+	// MOTD is the first line of the server name, and SubMOTD is the second one,
+	// which is usually a world name.
+	MOTD, SubMOTD string
+
+	ProtocolVersion int
+	Version         string
+	Online, Max     int
+
+	// ServerID is a server GUID. If zero, Listener fills it with Listener.ID.
+	ServerID uint64
+
+	GameMode   string
+	GameModeID int
+
+	PortV4, PortV6 int
+}
+
+// ErrInvalidStatus is returned when parsing a malformed ServerStatus.
+var ErrInvalidStatus = errors.New("raknet: invalid server status")
+
+// statusFields is a minimum number of fields of ServerStatus.
+// Fields after Max are optional for old servers.
+const statusFields = 6
+
+// escapeStatus removes semicolons from a field, as clients split fields
+// by every semicolon.
+func escapeStatus(s string) string {
+	return strings.Replace(s, ";", "", -1)
+}
+
+// String encodes the status.
+func (s ServerStatus) String() string {
+	fields := []string{
+		escapeStatus(s.Edition),
+		escapeStatus(s.MOTD),
+		strconv.Itoa(s.ProtocolVersion),
+		escapeStatus(s.Version),
+		strconv.Itoa(s.Online),
+		strconv.Itoa(s.Max),
+		strconv.FormatUint(s.ServerID, 10),
+		escapeStatus(s.SubMOTD),
+		escapeStatus(s.GameMode),
+		strconv.Itoa(s.GameModeID),
+		strconv.Itoa(s.PortV4),
+		strconv.Itoa(s.PortV6),
+	}
+	return strings.Join(fields, ";") + ";"
+}
+
+// ParseServerStatus parses an encoded ServerStatus.
+// Missing optional fields are left zero.
+func ParseServerStatus(str string) (ServerStatus, error) {
+	var s ServerStatus
+	fields := strings.Split(strings.TrimSuffix(str, ";"), ";")
+	if len(fields) < statusFields {
+		return s, ErrInvalidStatus
+	}
+
+	ints := []struct {
+		idx int
+		v   *int
+	}{
+		{2, &s.ProtocolVersion},
+		{4, &s.Online},
+		{5, &s.Max},
+		{9, &s.GameModeID},
+		{10, &s.PortV4},
+		{11, &s.PortV6},
+	}
+	for _, f := range ints {
+		if f.idx >= len(fields) || fields[f.idx] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(fields[f.idx])
+		if err != nil {
+			return s, ErrInvalidStatus
+		}
+		*f.v = n
+	}
+	if len(fields) > 6 && fields[6] != "" {
+		n, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return s, ErrInvalidStatus
+		}
+		s.ServerID = n
+	}
+
+	s.Edition = fields[0]
+	s.MOTD = fields[1]
+	s.Version = fields[3]
+	if len(fields) > 7 {
+		s.SubMOTD = fields[7]
+	}
+	if len(fields) > 8 {
+		s.GameMode = fields[8]
+	}
+	return s, nil
+}
@@ -0,0 +1,103 @@
+package raknet
+
+import (
+	"bytes"
+	"github.com/cr0sh/encore/util/binary"
+	"github.com/cr0sh/encore/util/packet"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerStatus(t *testing.T) {
+	cases := []struct {
+		status  ServerStatus
+		encoded string
+	}{
+		{ServerStatus{
+			Edition:         "MCPE",
+			MOTD:            "encore",
+			ProtocolVersion: 113,
+			Version:         "1.1.0",
+			Online:          3,
+			Max:             20,
+			ServerID:        1234,
+			SubMOTD:         "world",
+			GameMode:        "Survival",
+			GameModeID:      1,
+			PortV4:          19132,
+			PortV6:          19133,
+		}, "MCPE;encore;113;1.1.0;3;20;1234;world;Survival;1;19132;19133;"},
+		{ServerStatus{Edition: "MCPE", MOTD: `C:\`}, `MCPE;C:\;0;;0;0;0;;;0;0;0;`},
+	}
+	for i, c := range cases {
+		if s := c.status.String(); s != c.encoded {
+			t.Errorf("Test #%d: expected %q, got %q", i, c.encoded, s)
+		}
+		if s, err := ParseServerStatus(c.encoded); err != nil || s != c.status {
+			t.Errorf("Test #%d: expected %+v, got %+v(error %v)", i, c.status, s, err)
+		}
+	}
+
+	// Semicolons are removed from fields, so that other fields are not shifted.
+	status := ServerStatus{Edition: "MCPE", MOTD: `a;b\`, Version: "1;0", Max: 20, SubMOTD: `\;`}
+	expect := ServerStatus{Edition: "MCPE", MOTD: `ab\`, Version: "10", Max: 20, SubMOTD: `\`}
+	if s, err := ParseServerStatus(status.String()); err != nil || s != expect {
+		t.Errorf("Expected %+v, got %+v(error %v)", expect, s, err)
+	}
+
+	if s, err := ParseServerStatus("MCPE;encore;81;0.15.0;0;20"); err != nil || s.Max != 20 || s.Version != "0.15.0" {
+		t.Errorf("Expected old-style status parsed, got %+v(error %v)", s, err)
+	}
+	for _, invalid := range []string{"", "MCPE;encore", "MCPE;encore;x;1.1.0;0;20;"} {
+		if _, err := ParseServerStatus(invalid); err != ErrInvalidStatus {
+			t.Errorf("Expected ErrInvalidStatus for %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestListenerStatus(t *testing.T) {
+	online := 0
+	l, err := (&Config{Status: func() ServerStatus {
+		online++
+		return ServerStatus{Edition: "MCPE", MOTD: "encore", Online: online, Max: 20}
+	}}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 1; i <= 2; i++ {
+		buf := new(bytes.Buffer)
+		if err := packet.Marshal(&UnconnectedPing{PingID: uint64(i)}, buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, maxDatagramSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pong := new(UnconnectedPong)
+		if err := binary.Unmarshal(pong, bytes.NewReader(b[1:n])); err != nil {
+			t.Fatal(err)
+		}
+		status, err := ParseServerStatus(string(pong.ServerName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Online != i || status.ServerID != l.ID {
+			t.Errorf("Test #%d: expected %d online with server ID %d, got %+v", i, i, l.ID, status)
+		}
+	}
+}
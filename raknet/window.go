@@ -0,0 +1,117 @@
+package raknet
+
+// triadMask masks sequence numbers to 24 bits, as they are sent in triads.
+const triadMask = 1<<24 - 1
+
+// triadAhead reports whether the 24-bit sequence number a is the same as or
+// ahead of b, assuming they are within half the sequence space.
+func triadAhead(a, b uint32) bool {
+	return (a-b)&triadMask < (triadMask+1)/2
+}
+
+// Window is a sized buffer for reordering a stream of values indexed by
+// 24-bit sequence numbers. Values are put in any order within the window,
+// and popped in order of their indexes. Indexes wrap around after 1<<24-1.
+// The window grows for values put beyond it, up to MaxWindowSize.
+//
+// Window stores values, not pointers to them. If T refers to memory owned
+// by the caller(e.g. a slice of a datagram buffer), the caller must copy it
+// before Put if the memory is reused.
+// Window.Init must be called once for initialization.
+type Window[T any] struct {
+	start    uint32 // index of the next value to pop
+	head     int    // position of start in vals
+	vals     []T
+	received []bool
+	limit    int // size the window grows up to
+}
+
+// Init initializes Window with given initial size. If size is not positive,
+// WindowSize is used. Sizes over half the sequence space are truncated,
+// so that indexes behind the window are not taken as ones ahead.
+// Init returns the Window itself, so we can define
+// initialized Window with new(Window[T]).Init()
+func (w *Window[T]) Init(size int) *Window[T] {
+	if size <= 0 {
+		size = WindowSize
+	} else if size > (triadMask+1)/2 {
+		size = (triadMask + 1) / 2
+	}
+	w.start, w.head = 0, 0
+	w.limit = MaxWindowSize
+	if size > w.limit {
+		w.limit = size
+	}
+	w.vals = make([]T, size)
+	w.received = make([]bool, size)
+	return w
+}
+
+// Start returns the index of the next value to pop.
+func (w *Window[T]) Start() uint32 {
+	return w.start
+}
+
+// distance returns how far index is ahead of start, with wrap-around.
+func (w *Window[T]) distance(index uint32) uint32 {
+	return (index - w.start) & triadMask
+}
+
+// slot returns the position in vals of the value at distance d from start.
+func (w *Window[T]) slot(d uint32) int {
+	return (w.head + int(d)) % len(w.vals)
+}
+
+// Fits reports whether index is not too far ahead of the window to be put,
+// which means it is behind Start or within the size the window grows up to.
+func (w *Window[T]) Fits(index uint32) bool {
+	return !triadAhead(index, w.start) || w.distance(index) < uint32(w.limit)
+}
+
+// grow resizes the window to fit at least n values, keeping their order.
+func (w *Window[T]) grow(n int) {
+	size := len(w.vals)
+	for size < n {
+		size *= 2
+	}
+	if size > w.limit {
+		size = w.limit
+	}
+	vals, received := make([]T, size), make([]bool, size)
+	for d := range w.vals {
+		i := w.slot(uint32(d))
+		vals[d], received[d] = w.vals[i], w.received[i]
+	}
+	w.vals, w.received, w.head = vals, received, 0
+}
+
+// Put stores v at index, and reports whether it is accepted.
+// Indexes already popped or not fitting the window, and duplicates are not accepted.
+func (w *Window[T]) Put(index uint32, v T) bool {
+	d := w.distance(index)
+	if d >= uint32(w.limit) {
+		return false
+	}
+	if d >= uint32(len(w.vals)) {
+		w.grow(int(d) + 1)
+	}
+	i := w.slot(d)
+	if w.received[i] {
+		return false
+	}
+	w.vals[i], w.received[i] = v, true
+	return true
+}
+
+// Pop removes and returns the value at Start if it is received.
+func (w *Window[T]) Pop() (T, bool) {
+	var zero T
+	if !w.received[w.head] {
+		return zero, false
+	}
+	v := w.vals[w.head]
+	w.vals[w.head], w.received[w.head] = zero, false
+	w.head = (w.head + 1) % len(w.vals)
+	w.start = (w.start + 1) & triadMask
+	return v, true
+}